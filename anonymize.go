@@ -0,0 +1,75 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/dvaumoron/puzzleloginserver/model"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const anonymizeBatchSize = 1000
+
+type anonymizedUser struct {
+	User       string `json:"user"`
+	Registered string `json:"registered"`
+}
+
+// write one json line per user on stdout, without login nor raw id
+func exportAnonymized(db *gorm.DB, logger *otelzap.Logger) {
+	// a plain hash of sequential ids would be trivially reversed
+	key := os.Getenv("ANALYTICS_ID_KEY")
+	if key == "" {
+		logger.Fatal("ANALYTICS_ID_KEY is required to export anonymized users")
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	var users []model.User
+	err := db.Select("id", "created_at").FindInBatches(&users, anonymizeBatchSize, func(tx *gorm.DB, batch int) error {
+		for _, user := range users {
+			year, week := user.CreatedAt.ISOWeek()
+			if err := encoder.Encode(anonymizedUser{
+				User: hashId(key, user.ID), Registered: fmt.Sprintf("%d-W%02d", year, week),
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		logger.Fatal("Failed to export anonymized users", zap.Error(err))
+	}
+}
+
+func hashId(key string, id uint64) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	var idBytes [8]byte
+	binary.BigEndian.PutUint64(idBytes[:], id)
+	mac.Write(idBytes[:])
+	return hex.EncodeToString(mac.Sum(nil))
+}
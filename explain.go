@@ -0,0 +1,150 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	dbclient "github.com/dvaumoron/puzzledbclient"
+	"github.com/dvaumoron/puzzleloginserver/model"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const defaultSampleLogin = "sample"
+
+type keyQuery struct {
+	name  string
+	build func(tx *gorm.DB, login string) *gorm.DB
+}
+
+// same shapes as the requests sent by the loginserver package
+var keyQueries = []keyQuery{{
+	name: "verify by login",
+	build: func(tx *gorm.DB, login string) *gorm.DB {
+		var user model.User
+		return tx.First(&user, "login = ?", login)
+	},
+}, {
+	name: "count with filter",
+	build: func(tx *gorm.DB, login string) *gorm.DB {
+		var total int64
+		return tx.Model(&model.User{}).Where("login LIKE ?", dbclient.BuildLikeFilter(login)).Count(&total)
+	},
+}, {
+	name: "list with filter",
+	build: func(tx *gorm.DB, login string) *gorm.DB {
+		var users []model.User
+		return dbclient.Paginate(tx, 0, 10).Order("login asc").Find(&users, "login LIKE ?", dbclient.BuildLikeFilter(login))
+	},
+}}
+
+func explainKeyQueries(db *gorm.DB, logger *otelzap.Logger, args []string) {
+	login := defaultSampleLogin
+	if len(args) != 0 {
+		login = args[0]
+	}
+
+	kind := db.Dialector.Name()
+	explainPrefix, fullScan := explainDialect(kind)
+	if explainPrefix == "" {
+		logger.Fatal("Unsupported database type for explain", zap.String("kind", kind))
+	}
+
+	for _, query := range keyQueries {
+		sql := db.ToSQL(func(tx *gorm.DB) *gorm.DB {
+			return query.build(tx, login)
+		})
+
+		plan, err := explainPlan(db, explainPrefix+sql)
+		if err != nil {
+			logger.Fatal("Failed to explain query", zap.String("query", query.name), zap.Error(err))
+		}
+
+		fmt.Println("==", query.name)
+		fmt.Println(sql)
+		indexMissing := false
+		for _, line := range plan {
+			fmt.Println("  ", line)
+			indexMissing = indexMissing || fullScan(line)
+		}
+		if indexMissing {
+			fmt.Println("WARNING : no index used")
+		}
+		fmt.Println()
+	}
+}
+
+func explainDialect(kind string) (string, func(string) bool) {
+	switch kind {
+	case "postgres":
+		return "EXPLAIN ", func(line string) bool {
+			return strings.Contains(line, "Seq Scan")
+		}
+	case "mysql":
+		return "EXPLAIN ", func(line string) bool {
+			return strings.Contains(line, "type=ALL")
+		}
+	case "sqlite":
+		return "EXPLAIN QUERY PLAN ", func(line string) bool {
+			return strings.Contains(line, "SCAN") && !strings.Contains(line, "INDEX")
+		}
+	}
+	return "", nil
+}
+
+// each row is rendered as "column=value" pairs
+func explainPlan(db *gorm.DB, sql string) ([]string, error) {
+	rows, err := db.Raw(sql).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for index := range values {
+		pointers[index] = &values[index]
+	}
+
+	var plan []string
+	for rows.Next() {
+		if err = rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		parts := make([]string, 0, len(columns))
+		for index, column := range columns {
+			value := values[index]
+			if bytes, ok := value.([]byte); ok {
+				value = string(bytes)
+			}
+			parts = append(parts, fmt.Sprint(column, "=", value))
+		}
+		plan = append(plan, strings.Join(parts, " "))
+	}
+	return plan, rows.Err()
+}
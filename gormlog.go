@@ -0,0 +1,124 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	dbclient "github.com/dvaumoron/puzzledbclient"
+	"github.com/dvaumoron/puzzleloginserver/internal/envconfig"
+	"github.com/uptrace/opentelemetry-go-extra/otelgorm"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+const defaultSlowQuery = 200 * time.Millisecond
+
+// gormLogger routes the SQL logs through otelzap, so they are attached to the active span.
+type gormLogger struct {
+	logger    *otelzap.Logger
+	level     gormlogger.LogLevel
+	slowQuery time.Duration
+}
+
+func createDB(logger *otelzap.Logger) *gorm.DB {
+	db := dbclient.Create(logger)
+	db.Logger = gormLogger{logger: logger, level: gormlogger.Silent}
+	retraceDB(logger, db)
+	db.Logger = gormLogger{
+		logger: logger, level: gormlogger.Warn, slowQuery: envconfig.ReadDuration(logger, "DB_SLOW_QUERY", defaultSlowQuery),
+	}
+	return db
+}
+
+func (l gormLogger) LogMode(level gormlogger.LogLevel) gormlogger.Interface {
+	l.level = level
+	return l
+}
+
+func (l gormLogger) Info(ctx context.Context, msg string, data ...any) {
+	if l.level >= gormlogger.Info {
+		l.logger.Ctx(ctx).Info(fmt.Sprintf(msg, data...))
+	}
+}
+
+func (l gormLogger) Warn(ctx context.Context, msg string, data ...any) {
+	if l.level >= gormlogger.Warn {
+		l.logger.Ctx(ctx).Warn(fmt.Sprintf(msg, data...))
+	}
+}
+
+func (l gormLogger) Error(ctx context.Context, msg string, data ...any) {
+	if l.level >= gormlogger.Error {
+		l.logger.Ctx(ctx).Error(fmt.Sprintf(msg, data...))
+	}
+}
+
+// unknown logins are expected, so record not found is not an error here
+func (l gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	if l.level == gormlogger.Silent {
+		return
+	}
+
+	duration := time.Since(begin)
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && l.level >= gormlogger.Error:
+		sql, rows := fc()
+		l.logger.Ctx(ctx).Error("Query failed", zap.String("sql", sql), zap.Int64("rows", rows), zap.Duration("duration", duration), zap.Error(err))
+	case duration > l.slowQuery && l.level >= gormlogger.Warn:
+		sql, rows := fc()
+		l.logger.Ctx(ctx).Warn("Slow query", zap.String("sql", sql), zap.Int64("rows", rows), zap.Duration("duration", duration))
+	case l.level >= gormlogger.Info:
+		sql, rows := fc()
+		l.logger.Ctx(ctx).Debug("Query", zap.String("sql", sql), zap.Int64("rows", rows), zap.Duration("duration", duration))
+	}
+}
+
+// retraceDB swaps the tracing plugin installed by dbclient.Create for one without the query
+// variables, the span statements would otherwise carry the logins and password hashes
+// (pool metrics are already reported by the first registration)
+func retraceDB(logger *otelzap.Logger, db *gorm.DB) {
+	callbacks := db.Callback()
+	for _, step := range [...]struct {
+		processor interface{ Remove(string) error }
+		name      string
+	}{
+		{callbacks.Create(), "create"}, {callbacks.Query(), "select"}, {callbacks.Delete(), "delete"},
+		{callbacks.Update(), "update"}, {callbacks.Row(), "row"}, {callbacks.Raw(), "raw"},
+	} {
+		step.processor.Remove("otel:before:" + step.name)
+		step.processor.Remove("otel:after:" + step.name)
+	}
+	delete(db.Plugins, "otelgorm")
+
+	plugin := otelgorm.NewPlugin(otelgorm.WithDBName(db.Dialector.Name()), otelgorm.WithoutQueryVariables(), otelgorm.WithoutMetrics())
+	if err := db.Use(plugin); err != nil {
+		logger.Fatal("Failed to register the tracing plugin", zap.Error(err))
+	}
+}
+
+// bound values are dropped from the logged statements, they include logins and password hashes
+func (gormLogger) ParamsFilter(ctx context.Context, sql string, params ...any) (string, []any) {
+	return sql, nil
+}
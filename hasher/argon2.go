@@ -0,0 +1,119 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package hasher
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const argon2Prefix = "$argon2id$"
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+	// shorter stored values are refused (argon2.IDKey panics on some of them)
+	argon2MinSaltLen = 8
+	argon2MinKeyLen  = 16
+)
+
+// stored values are read before any check of the credential, so their cost must stay bounded
+// (a value above them could ask for terabytes of memory)
+const (
+	Argon2MaxMemory  = 1024 * 1024 // KiB
+	Argon2MaxTime    = 64
+	Argon2MaxThreads = 64
+)
+
+// Argon2 hashes with argon2id, Memory is in KiB.
+type Argon2 struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+// encoded in the PHC string format, with a random salt for each call
+func (a Argon2) Hash(salted string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(salted), salt, a.Time, a.Memory, a.Threads, argon2KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version, a.Memory, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// parameters are read from the stored hash, so changing the configuration does not break existing users
+func (Argon2) Compare(hashed string, salted string) (bool, error) {
+	params, salt, key, err := decodeArgon2(hashed)
+	if err != nil {
+		return false, err
+	}
+
+	computed := argon2.IDKey([]byte(salted), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+func (a Argon2) NeedsRehash(hashed string) bool {
+	params, _, _, err := decodeArgon2(hashed)
+	return err != nil || params != a
+}
+
+// Bounded reports whether the parameters are in the accepted range.
+func (a Argon2) Bounded() bool {
+	return a.Time >= 1 && a.Time <= Argon2MaxTime && a.Threads >= 1 && a.Threads <= Argon2MaxThreads &&
+		a.Memory <= Argon2MaxMemory
+}
+
+func decodeArgon2(hashed string) (Argon2, []byte, []byte, error) {
+	var params Argon2
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrMalformedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrMalformedHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, ErrMalformedHash
+	}
+	if !params.Bounded() {
+		return params, nil, nil, ErrMalformedHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) < argon2MinSaltLen {
+		return params, nil, nil, ErrMalformedHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) < argon2MinKeyLen {
+		return params, nil, nil, ErrMalformedHash
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,64 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package hasher
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const defaultBcryptCost = bcrypt.DefaultCost
+
+// Bcrypt hashes a SHA-256 digest of the salted value,
+// because bcrypt refuses inputs longer than 72 bytes (a SHA-512 hexadecimal string has 128).
+type Bcrypt struct {
+	Cost int
+}
+
+func (b Bcrypt) Hash(salted string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword(bcryptInput(salted), b.Cost)
+	return string(hashed), err
+}
+
+func (Bcrypt) Compare(hashed string, salted string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hashed), bcryptInput(salted))
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return false, ErrMalformedHash
+}
+
+// only upgrades, lowering the configured cost does not weaken existing hashes
+func (b Bcrypt) NeedsRehash(hashed string) bool {
+	cost, err := bcrypt.Cost([]byte(hashed))
+	return err != nil || cost < b.Cost
+}
+
+func bcryptInput(salted string) []byte {
+	digest := sha256.Sum256([]byte(salted))
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(digest)))
+	base64.StdEncoding.Encode(encoded, digest[:])
+	return encoded
+}
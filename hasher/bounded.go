@@ -0,0 +1,118 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package hasher
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"time"
+)
+
+var ErrOverloaded = errors.New("too many pending hash computations")
+
+// exposed with the other debug variables
+var (
+	hashInFlight = expvar.NewInt("hashInFlight")
+	hashQueued   = expvar.NewInt("hashQueued")
+	hashRejected = expvar.NewInt("hashRejected")
+)
+
+// Bounded limits the number of concurrent computations of Inner,
+// a call waiting more than QueueTimeout for a slot fails with ErrOverloaded.
+type Bounded struct {
+	Inner        Hasher
+	QueueTimeout time.Duration
+	slots        chan struct{}
+	// set by WithContext, ends the wait for a slot
+	ctx context.Context
+}
+
+func NewBounded(inner Hasher, workers int, queueTimeout time.Duration) Bounded {
+	return Bounded{Inner: inner, QueueTimeout: queueTimeout, slots: make(chan struct{}, workers)}
+}
+
+// WithContext returns h with the wait for a slot of Bounded ending with ctx (its error is returned),
+// the other hashers do not wait and are returned as is.
+func WithContext(ctx context.Context, h Hasher) Hasher {
+	if bounded, ok := h.(Bounded); ok {
+		bounded.ctx = ctx
+		return bounded
+	}
+	return h
+}
+
+func (b Bounded) Hash(salted string) (string, error) {
+	if err := b.acquire(); err != nil {
+		return "", err
+	}
+	defer b.release()
+
+	return b.Inner.Hash(salted)
+}
+
+func (b Bounded) Compare(hashed string, salted string) (bool, error) {
+	if err := b.acquire(); err != nil {
+		return false, err
+	}
+	defer b.release()
+
+	return b.Inner.Compare(hashed, salted)
+}
+
+// only inspects the stored value, no need to wait
+func (b Bounded) NeedsRehash(hashed string) bool {
+	return b.Inner.NeedsRehash(hashed)
+}
+
+func (b Bounded) acquire() error {
+	select {
+	case b.slots <- struct{}{}:
+		hashInFlight.Add(1)
+		return nil
+	default:
+	}
+
+	// a nil channel never fires when there is no context
+	var done <-chan struct{}
+	if b.ctx != nil {
+		done = b.ctx.Done()
+	}
+
+	hashQueued.Add(1)
+	defer hashQueued.Add(-1)
+
+	timer := time.NewTimer(b.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case b.slots <- struct{}{}:
+		hashInFlight.Add(1)
+		return nil
+	case <-timer.C:
+		hashRejected.Add(1)
+		return ErrOverloaded
+	case <-done:
+		return b.ctx.Err()
+	}
+}
+
+func (b Bounded) release() {
+	hashInFlight.Add(-1)
+	<-b.slots
+}
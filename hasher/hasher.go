@@ -0,0 +1,136 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package hasher
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dvaumoron/puzzleloginserver/internal/envconfig"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrMalformedHash = errors.New("malformed password hash")
+
+// ErrInvalidSalted is returned when a value to store is not a digest (or could be mistaken for another scheme).
+var ErrInvalidSalted = errors.New("salted value is not a hexadecimal digest")
+
+// Hasher handles the stored form of the salted credential sent by clients.
+type Hasher interface {
+	Hash(salted string) (string, error)
+	Compare(hashed string, salted string) (bool, error)
+	// NeedsRehash reports whether hashed was produced with other settings than the current ones.
+	NeedsRehash(hashed string) bool
+}
+
+// Create returns the Hasher selected with PASSWORD_HASH (sha512, bcrypt, argon2id),
+// the sha512 compatibility mode is the default. Values stored with another scheme are still accepted.
+// When PASSWORD_PEPPER_ID is set, the matching pepper from PASSWORD_PEPPERS is mixed in,
+// the other peppers of PASSWORD_PEPPERS are kept to compare the values stored with them.
+// HASH_WORKERS bounds the concurrent computations.
+func Create(logger *otelzap.Logger) Hasher {
+	var peppers PepperProvider
+	if envPeppers := ReadEnvPeppers(logger); len(envPeppers) != 0 {
+		peppers = envPeppers
+	}
+	return CreateWithPeppers(logger, peppers)
+}
+
+// CreateWithPeppers is Create with another source for the peppers (nil when there is none).
+func CreateWithPeppers(logger *otelzap.Logger, peppers PepperProvider) Hasher {
+	var h Hasher = Migrating{Current: createCurrent(logger)}
+	pepperId := os.Getenv("PASSWORD_PEPPER_ID")
+	if peppers == nil {
+		if pepperId != "" {
+			logger.Fatal("PASSWORD_PEPPER_ID is set without peppers", zap.String("id", pepperId))
+		}
+	} else {
+		if pepperId != "" {
+			if _, err := peppers.Pepper(pepperId); err != nil {
+				logger.Fatal("Failed to load current pepper", zap.String("id", pepperId), zap.Error(err))
+			}
+		}
+		h = Peppered{Inner: h, CurrentId: pepperId, Peppers: peppers}
+	}
+	if workers := envconfig.ReadUint(logger, "HASH_WORKERS", 0, 16); workers != 0 {
+		h = NewBounded(h, int(workers), envconfig.ReadDuration(logger, "HASH_QUEUE_TIMEOUT", time.Second))
+	}
+	return h
+}
+
+func createCurrent(logger *otelzap.Logger) Hasher {
+	switch mode := strings.ToLower(os.Getenv("PASSWORD_HASH")); mode {
+	case "", SHA512Scheme:
+		return SHA512Compat{}
+	case BcryptScheme:
+		// bcrypt would silently replace a cost under its minimum by its default
+		cost := int(envconfig.ReadUint(logger, "BCRYPT_COST", uint64(defaultBcryptCost), 8))
+		if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			logger.Fatal("BCRYPT_COST out of range", zap.Int("cost", cost), zap.Int("min", bcrypt.MinCost), zap.Int("max", bcrypt.MaxCost))
+		}
+		return Bcrypt{Cost: cost}
+	case Argon2Scheme:
+		params := Argon2{
+			Memory:  uint32(envconfig.ReadUint(logger, "ARGON2_MEMORY", 64*1024, 32)),
+			Time:    uint32(envconfig.ReadUint(logger, "ARGON2_TIME", 3, 32)),
+			Threads: uint8(envconfig.ReadUint(logger, "ARGON2_THREADS", 4, 8)),
+		}
+		// the stored values would be refused as malformed
+		if !params.Bounded() {
+			logger.Fatal("Argon2 parameters out of range", zap.Uint32("memory", params.Memory), zap.Uint32("time", params.Time),
+				zap.Uint8("threads", params.Threads),
+			)
+		}
+		return params
+	default:
+		logger.Fatal("Unknown password hash mode", zap.String("mode", mode))
+	}
+	return nil
+}
+
+// SHA512Compat stores the SHA-512 hexadecimal value computed by clients as is.
+type SHA512Compat struct{}
+
+// the value is stored as is, so it has to be a digest : a prefixed one would pick another scheme when compared
+// (the HMAC-SHA256 mix is accepted for the peppered form)
+func (SHA512Compat) Hash(salted string) (string, error) {
+	if len(salted) != sha512.Size*2 && len(salted) != sha256.Size*2 {
+		return "", ErrInvalidSalted
+	}
+	if _, err := hex.DecodeString(salted); err != nil {
+		return "", ErrInvalidSalted
+	}
+	return salted, nil
+}
+
+func (SHA512Compat) Compare(hashed string, salted string) (bool, error) {
+	return subtle.ConstantTimeCompare([]byte(hashed), []byte(salted)) == 1, nil
+}
+
+func (SHA512Compat) NeedsRehash(hashed string) bool {
+	return false
+}
@@ -0,0 +1,260 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package hasher
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cheap parameters, the tests check the formats not the cost
+var (
+	testArgon2 = Argon2{Memory: 64, Time: 1, Threads: 1}
+	testBcrypt = Bcrypt{Cost: 4}
+	testPepper = EnvPeppers{"p1": []byte("first secret"), "p2": []byte("second secret")}
+)
+
+func clientHash(password string) string {
+	digest := sha512.Sum512([]byte("salt" + password))
+	return hex.EncodeToString(digest[:])
+}
+
+func TestRoundTrip(t *testing.T) {
+	cases := []struct {
+		name   string
+		hasher Hasher
+		scheme string
+	}{
+		{"sha512", SHA512Compat{}, SHA512Scheme},
+		{"bcrypt", testBcrypt, BcryptScheme},
+		{"argon2id", testArgon2, Argon2Scheme},
+		{"migrating", Migrating{Current: testArgon2}, Argon2Scheme},
+		{"peppered", Peppered{Inner: Migrating{Current: testBcrypt}, CurrentId: "p1", Peppers: testPepper}, BcryptScheme},
+		{"unpeppered", Peppered{Inner: Migrating{Current: testBcrypt}, Peppers: testPepper}, BcryptScheme},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			salted := clientHash("password")
+			hashed, err := c.hasher.Hash(salted)
+			if err != nil {
+				t.Fatalf("Hash failed: %v", err)
+			}
+			if scheme := Scheme(hashed); scheme != c.scheme {
+				t.Errorf("Scheme() = %q, want %q", scheme, c.scheme)
+			}
+			if !WellFormed(hashed) {
+				t.Errorf("WellFormed(%q) = false", hashed)
+			}
+			if ok, err := c.hasher.Compare(hashed, salted); err != nil || !ok {
+				t.Errorf("Compare(right) = %v, %v", ok, err)
+			}
+			if ok, err := c.hasher.Compare(hashed, clientHash("wrong")); err != nil || ok {
+				t.Errorf("Compare(wrong) = %v, %v", ok, err)
+			}
+			if c.hasher.NeedsRehash(hashed) {
+				t.Errorf("NeedsRehash() = true just after Hash")
+			}
+		})
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	cases := []struct {
+		name   string
+		hashed string
+	}{
+		{"argon2id parts", "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ"},
+		{"argon2id version", "$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5a2V5"},
+		{"argon2id zero time", "$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5a2V5"},
+		{"argon2id zero threads", "$argon2id$v=19$m=64,t=1,p=0$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5a2V5"},
+		{"argon2id empty salt", "$argon2id$v=19$m=64,t=1,p=1$$a2V5a2V5a2V5a2V5a2V5a2V5"},
+		{"argon2id short key", "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5"},
+		{"argon2id huge memory", "$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5a2V5"},
+		{"argon2id huge time", "$argon2id$v=19$m=64,t=4294967295,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5a2V5"},
+		{"argon2id huge threads", "$argon2id$v=19$m=64,t=1,p=255$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5a2V5"},
+		{"bcrypt", "$2a$04$short"},
+		{"sha512 length", "abcd"},
+		{"sha512 hexadecimal", strings.Repeat("z", 128)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if WellFormed(c.hashed) {
+				t.Errorf("WellFormed(%q) = true", c.hashed)
+			}
+			if Scheme(c.hashed) == SHA512Scheme {
+				return
+			}
+			if ok, err := (Migrating{Current: testArgon2}).Compare(c.hashed, clientHash("password")); err != ErrMalformedHash || ok {
+				t.Errorf("Compare() = %v, %v, want false, %v", ok, err, ErrMalformedHash)
+			}
+		})
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	salted := clientHash("password")
+	mustHash := func(h Hasher) string {
+		hashed, err := h.Hash(salted)
+		if err != nil {
+			t.Fatalf("Hash failed: %v", err)
+		}
+		return hashed
+	}
+	sha512Hash := mustHash(SHA512Compat{})
+	bcryptHash := mustHash(testBcrypt)
+	argon2Hash := mustHash(testArgon2)
+	pepperedHash := mustHash(Peppered{Inner: Migrating{Current: testBcrypt}, CurrentId: "p1", Peppers: testPepper})
+
+	cases := []struct {
+		name   string
+		hasher Hasher
+		hashed string
+		want   bool
+	}{
+		{"sha512 to bcrypt", Migrating{Current: testBcrypt}, sha512Hash, true},
+		{"sha512 to argon2id", Migrating{Current: testArgon2}, sha512Hash, true},
+		{"bcrypt to argon2id", Migrating{Current: testArgon2}, bcryptHash, true},
+		{"argon2id to bcrypt", Migrating{Current: testBcrypt}, argon2Hash, false},
+		{"bcrypt to sha512", Migrating{Current: SHA512Compat{}}, bcryptHash, false},
+		{"bcrypt higher cost", Migrating{Current: Bcrypt{Cost: 5}}, bcryptHash, true},
+		{"bcrypt lower cost", Migrating{Current: Bcrypt{Cost: 4}}, mustHash(Bcrypt{Cost: 5}), false},
+		{"argon2id other params", Migrating{Current: Argon2{Memory: 128, Time: 1, Threads: 1}}, argon2Hash, true},
+		{"pepper added", Peppered{Inner: Migrating{Current: testBcrypt}, CurrentId: "p1", Peppers: testPepper}, bcryptHash, true},
+		{"pepper rotated", Peppered{Inner: Migrating{Current: testBcrypt}, CurrentId: "p2", Peppers: testPepper}, pepperedHash, true},
+		{"pepper retired", Peppered{Inner: Migrating{Current: testBcrypt}, Peppers: testPepper}, pepperedHash, true},
+		{"pepper downgrade", Peppered{Inner: Migrating{Current: SHA512Compat{}}, CurrentId: "p1", Peppers: testPepper}, pepperedHash, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.hasher.NeedsRehash(c.hashed); got != c.want {
+				t.Errorf("NeedsRehash() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestPepperErrors(t *testing.T) {
+	salted := clientHash("password")
+	hashed, err := Peppered{Inner: Migrating{Current: testBcrypt}, CurrentId: "p1", Peppers: testPepper}.Hash(salted)
+	if err != nil {
+		t.Fatalf("Hash failed: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		hasher Hasher
+	}{
+		{"no peppers", Migrating{Current: testBcrypt}},
+		{"unknown id", Peppered{Inner: Migrating{Current: testBcrypt}, CurrentId: "p2", Peppers: EnvPeppers{"p2": []byte("second secret")}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if ok, err := c.hasher.Compare(hashed, salted); err != ErrUnknownPepper || ok {
+				t.Errorf("Compare() = %v, %v, want false, %v", ok, err, ErrUnknownPepper)
+			}
+		})
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	cases := []struct {
+		name   string
+		hashed string
+		want   string
+	}{
+		{"sha512", clientHash("password"), "sha512"},
+		{"bcrypt", "$2a$04$abcdefghijklmnopqrstuuG8bm5Kz0Y1vB3AjL5nsT3sIbbgW9FSO", "bcrypt cost=4"},
+		{"argon2id", "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5a2V5", "argon2id m=64,t=1,p=1"},
+		{"argon2id malformed", "$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5a2V5", "argon2id malformed"},
+		{"bcrypt malformed", "$2a$xx", "bcrypt malformed"},
+		{"peppered", "$pepper$p1:$2a$04$abcdefghijklmnopqrstuuG8bm5Kz0Y1vB3AjL5nsT3sIbbgW9FSO", "bcrypt cost=4 pepper=p1"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := Describe(c.hashed); got != c.want {
+				t.Errorf("Describe() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSHA512CompatRefusesNonDigests(t *testing.T) {
+	cases := []struct {
+		name   string
+		salted string
+		want   error
+	}{
+		{"sha512 digest", clientHash("password"), nil},
+		{"hmac-sha256 mix", strings.Repeat("ab", 32), nil},
+		{"argon2id value", "$argon2id$v=19$m=4294967295,t=4294967295,p=255$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5a2V5a2V5", ErrInvalidSalted},
+		{"bcrypt value", "$2a$04$abcdefghijklmnopqrstuuG8bm5Kz0Y1vB3AjL5nsT3sIbbgW9FSO", ErrInvalidSalted},
+		{"not hexadecimal", strings.Repeat("z", 128), ErrInvalidSalted},
+		{"empty", "", ErrInvalidSalted},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := (SHA512Compat{}).Hash(c.salted); err != c.want {
+				t.Errorf("Hash() = %v, want %v", err, c.want)
+			}
+		})
+	}
+}
+
+func TestBoundedContext(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	cases := []struct {
+		name     string
+		ctx      context.Context
+		slotFree bool
+		want     error
+	}{
+		{"free slot", canceled, true, nil},
+		{"canceled while queued", canceled, false, context.Canceled},
+		{"queue timeout", context.Background(), false, ErrOverloaded},
+		{"queue timeout without context", nil, false, ErrOverloaded},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			bounded := NewBounded(SHA512Compat{}, 1, 50*time.Millisecond)
+			if !c.slotFree {
+				bounded.slots <- struct{}{}
+			}
+			h := Hasher(bounded)
+			if c.ctx != nil {
+				h = WithContext(c.ctx, h)
+			}
+
+			start := time.Now()
+			_, err := h.Compare(clientHash("password"), clientHash("password"))
+			if !errors.Is(err, c.want) {
+				t.Errorf("Compare() = %v, want %v", err, c.want)
+			}
+			// the canceled context must not wait for the queue timeout
+			if c.want == context.Canceled && time.Since(start) >= bounded.QueueTimeout {
+				t.Errorf("Compare() waited %v, want less than %v", time.Since(start), bounded.QueueTimeout)
+			}
+		})
+	}
+}
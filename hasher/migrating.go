@@ -0,0 +1,155 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package hasher
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	SHA512Scheme = "sha512"
+	BcryptScheme = "bcrypt"
+	Argon2Scheme = "argon2id"
+)
+
+// stored values are only rewritten towards a stronger scheme
+var schemeStrength = map[string]int{SHA512Scheme: 0, BcryptScheme: 1, Argon2Scheme: 2}
+
+// Scheme identifies the hash format from its prefix,
+// unprefixed values are the historical form where the client SHA-512 is stored as is.
+func Scheme(hashed string) string {
+	_, hashed, _ = splitPepper(hashed)
+	switch {
+	case strings.HasPrefix(hashed, argon2Prefix):
+		return Argon2Scheme
+	case strings.HasPrefix(hashed, "$2a$"), strings.HasPrefix(hashed, "$2b$"), strings.HasPrefix(hashed, "$2y$"):
+		return BcryptScheme
+	}
+	return SHA512Scheme
+}
+
+// Migrating hashes with Current but compares with the scheme of each stored value,
+// allowing a population with mixed schemes to be upgraded on successful login.
+type Migrating struct {
+	Current Hasher
+}
+
+func (m Migrating) Hash(salted string) (string, error) {
+	return m.Current.Hash(salted)
+}
+
+// a peppered value reaching Migrating means its pepper is not configured
+func (m Migrating) Compare(hashed string, salted string) (bool, error) {
+	if _, _, peppered := splitPepper(hashed); peppered {
+		return false, ErrUnknownPepper
+	}
+	return comparerFor(hashed).Compare(hashed, salted)
+}
+
+// only upgrades, configuring a weaker scheme (like going back to sha512, which stores a replayable value)
+// keeps the existing hashes as they are
+func (m Migrating) NeedsRehash(hashed string) bool {
+	if Scheme(hashed) != schemeOf(m.Current) {
+		return !downgrades(hashed, m.Current)
+	}
+	return m.Current.NeedsRehash(hashed)
+}
+
+func downgrades(hashed string, target Hasher) bool {
+	return schemeStrength[Scheme(hashed)] > schemeStrength[schemeOf(target)]
+}
+
+// comparison settings are read from the stored value, zero configurations are enough
+func comparerFor(hashed string) Hasher {
+	switch Scheme(hashed) {
+	case Argon2Scheme:
+		return Argon2{}
+	case BcryptScheme:
+		return Bcrypt{}
+	}
+	return SHA512Compat{}
+}
+
+func schemeOf(h Hasher) string {
+	switch casted := h.(type) {
+	case Argon2:
+		return Argon2Scheme
+	case Bcrypt:
+		return BcryptScheme
+	case Migrating:
+		return schemeOf(casted.Current)
+	case Peppered:
+		return schemeOf(casted.Inner)
+	case Bounded:
+		return schemeOf(casted.Inner)
+	}
+	return SHA512Scheme
+}
+
+// Describe renders the scheme with the parameters read from the stored value,
+// grouping users by it gives the distribution of a mixed population.
+func Describe(hashed string) string {
+	pepperId, hashed, peppered := splitPepper(hashed)
+	description := Scheme(hashed)
+	switch description {
+	case Argon2Scheme:
+		if params, _, _, err := decodeArgon2(hashed); err == nil {
+			description += fmt.Sprintf(" m=%d,t=%d,p=%d", params.Memory, params.Time, params.Threads)
+		} else {
+			description += " malformed"
+		}
+	case BcryptScheme:
+		if cost, err := bcrypt.Cost([]byte(hashed)); err == nil {
+			description += " cost=" + strconv.Itoa(cost)
+		} else {
+			description += " malformed"
+		}
+	}
+	if peppered {
+		description += " pepper=" + pepperId
+	}
+	return description
+}
+
+// WellFormed checks the stored value can be read by the scheme its prefix designates.
+func WellFormed(hashed string) bool {
+	_, hashed, peppered := splitPepper(hashed)
+	switch Scheme(hashed) {
+	case Argon2Scheme:
+		_, _, _, err := decodeArgon2(hashed)
+		return err == nil
+	case BcryptScheme:
+		_, err := bcrypt.Cost([]byte(hashed))
+		return err == nil
+	}
+	// hexadecimal SHA-512 from clients, or the HMAC-SHA256 mix when peppered
+	expectedLen := sha512.Size
+	if peppered {
+		expectedLen = sha256.Size
+	}
+	decoded, err := hex.DecodeString(hashed)
+	return err == nil && len(decoded) == expectedLen
+}
@@ -0,0 +1,145 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package hasher
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+)
+
+const pepperPrefix = "$pepper$"
+
+var ErrUnknownPepper = errors.New("unknown pepper id")
+
+// PepperProvider gives the secret matching a pepper id,
+// it allows to back peppers with a KMS or a Vault instead of the environment
+// (the binary only reads EnvPeppers, another source needs its own main calling CreateWithPeppers).
+type PepperProvider interface {
+	Pepper(id string) ([]byte, error)
+}
+
+// EnvPeppers are read from PASSWORD_PEPPERS ("id:base64,id2:base64").
+type EnvPeppers map[string][]byte
+
+func ReadEnvPeppers(logger *otelzap.Logger) EnvPeppers {
+	peppers := EnvPeppers{}
+	peppersStr := os.Getenv("PASSWORD_PEPPERS")
+	if peppersStr == "" {
+		return peppers
+	}
+
+	for _, pepperStr := range strings.Split(peppersStr, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(pepperStr), ":")
+		if !ok || id == "" {
+			logger.Fatal("Failed to parse PASSWORD_PEPPERS, expected id:base64")
+		}
+
+		pepper, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			logger.Fatal("Failed to decode pepper", zap.String("id", id), zap.Error(err))
+		}
+		peppers[id] = pepper
+	}
+	return peppers
+}
+
+func (e EnvPeppers) Pepper(id string) ([]byte, error) {
+	pepper, ok := e[id]
+	if !ok {
+		return nil, ErrUnknownPepper
+	}
+	return pepper, nil
+}
+
+// Peppered mixes a secret kept outside the database into the salted value before calling Inner,
+// the stored form is "$pepper$<id>:" followed by the Inner hash, so peppers can be rotated.
+// With an empty CurrentId, new values are not peppered but the peppered ones are still accepted
+// (and rehashed), so a pepper can be retired.
+type Peppered struct {
+	Inner     Hasher
+	CurrentId string
+	Peppers   PepperProvider
+}
+
+func (p Peppered) Hash(salted string) (string, error) {
+	if p.CurrentId == "" {
+		return p.Inner.Hash(salted)
+	}
+
+	mixed, err := p.mix(p.CurrentId, salted)
+	if err != nil {
+		return "", err
+	}
+
+	hashed, err := p.Inner.Hash(mixed)
+	if err != nil {
+		return "", err
+	}
+	return pepperPrefix + p.CurrentId + ":" + hashed, nil
+}
+
+// values stored before the pepper was introduced are still accepted
+func (p Peppered) Compare(hashed string, salted string) (bool, error) {
+	id, innerHashed, peppered := splitPepper(hashed)
+	if !peppered {
+		return p.Inner.Compare(hashed, salted)
+	}
+
+	mixed, err := p.mix(id, salted)
+	if err != nil {
+		return false, err
+	}
+	return p.Inner.Compare(innerHashed, mixed)
+}
+
+func (p Peppered) NeedsRehash(hashed string) bool {
+	id, innerHashed, _ := splitPepper(hashed)
+	if downgrades(innerHashed, p.Inner) {
+		return false
+	}
+	return id != p.CurrentId || p.Inner.NeedsRehash(innerHashed)
+}
+
+func (p Peppered) mix(id string, salted string) (string, error) {
+	pepper, err := p.Peppers.Pepper(id)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(salted))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func splitPepper(hashed string) (string, string, bool) {
+	if !strings.HasPrefix(hashed, pepperPrefix) {
+		return "", hashed, false
+	}
+
+	id, innerHashed, ok := strings.Cut(hashed[len(pepperPrefix):], ":")
+	return id, innerHashed, ok
+}
@@ -0,0 +1,74 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/dvaumoron/puzzleloginserver/hasher"
+	"github.com/dvaumoron/puzzleloginserver/model"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const hashStatsBatchSize = 1000
+
+// count users by hash scheme and parameters, and those the current configuration would rehash
+func hashStats(db *gorm.DB, logger *otelzap.Logger, args []string) {
+	flags := flag.NewFlagSet("hash-stats", flag.ExitOnError)
+	printIds := flags.Bool("ids", false, "print the ids of the users needing a rehash")
+	flags.Parse(args)
+
+	current := hasher.Create(logger)
+	counts := map[string]int{}
+	total, outdated := 0, 0
+	var users []model.User
+	err := db.Select("id", "password").FindInBatches(&users, hashStatsBatchSize, func(tx *gorm.DB, batch int) error {
+		for _, user := range users {
+			counts[hasher.Describe(user.Password)]++
+			total++
+			if current.NeedsRehash(user.Password) {
+				outdated++
+				if *printIds {
+					fmt.Println(user.ID)
+				}
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		logger.Fatal("Failed to read hashes", zap.Error(err))
+	}
+	if *printIds {
+		return
+	}
+
+	descriptions := make([]string, 0, len(counts))
+	for description := range counts {
+		descriptions = append(descriptions, description)
+	}
+	sort.Strings(descriptions)
+	for _, description := range descriptions {
+		fmt.Printf("%8d %s\n", counts[description], description)
+	}
+	fmt.Printf("%d users, %d needing a rehash\n", total, outdated)
+}
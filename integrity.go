@@ -0,0 +1,113 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/dvaumoron/puzzleloginserver/hasher"
+	"github.com/dvaumoron/puzzleloginserver/model"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	emptyLoginIssue     = "empty_login"
+	duplicateLoginIssue = "duplicate_login"
+	unknownHashIssue    = "unknown_hash"
+	orphanHistoryIssue  = "orphan_history"
+)
+
+const integrityBatchSize = 1000
+
+type integrityIssue struct {
+	Kind string `json:"kind"`
+	// users involved, or password history entries for orphan_history
+	Ids []uint64 `json:"ids"`
+}
+
+type integrityReport struct {
+	CheckedUsers int              `json:"checkedUsers"`
+	Issues       []integrityIssue `json:"issues"`
+}
+
+// print the report as json on stdout and exit with 1 when an issue is found, to be usable from schedulers
+func checkIntegrityCommand(db *gorm.DB, logger *otelzap.Logger) {
+	report, err := checkIntegrity(db)
+	if err != nil {
+		logger.Fatal("Failed to check integrity", zap.Error(err))
+	}
+
+	if err = json.NewEncoder(os.Stdout).Encode(report); err != nil {
+		logger.Fatal("Failed to write integrity report", zap.Error(err))
+	}
+	if len(report.Issues) != 0 {
+		os.Exit(1)
+	}
+}
+
+func checkIntegrity(db *gorm.DB) (integrityReport, error) {
+	report := integrityReport{Issues: []integrityIssue{}}
+	// logins differing only by case or surrounding spaces are counted as duplicates
+	idsByLogin := map[string][]uint64{}
+	var logins []string
+	var users []model.User
+	err := db.Select("id", "login", "password").FindInBatches(&users, integrityBatchSize, func(tx *gorm.DB, batch int) error {
+		for _, user := range users {
+			report.CheckedUsers++
+			login := strings.ToLower(strings.TrimSpace(user.Login))
+			if login == "" {
+				report.Issues = append(report.Issues, integrityIssue{Kind: emptyLoginIssue, Ids: []uint64{user.ID}})
+			} else {
+				if _, ok := idsByLogin[login]; !ok {
+					logins = append(logins, login)
+				}
+				idsByLogin[login] = append(idsByLogin[login], user.ID)
+			}
+			if !hasher.WellFormed(user.Password) {
+				report.Issues = append(report.Issues, integrityIssue{Kind: unknownHashIssue, Ids: []uint64{user.ID}})
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return report, err
+	}
+
+	for _, login := range logins {
+		if ids := idsByLogin[login]; len(ids) > 1 {
+			report.Issues = append(report.Issues, integrityIssue{Kind: duplicateLoginIssue, Ids: ids})
+		}
+	}
+
+	var orphanIds []uint64
+	err = db.Model(&model.PasswordHistory{}).Where(
+		"user_id NOT IN (?)", db.Model(&model.User{}).Select("id"),
+	).Pluck("id", &orphanIds).Error
+	if err != nil {
+		return report, err
+	}
+	if len(orphanIds) != 0 {
+		report.Issues = append(report.Issues, integrityIssue{Kind: orphanHistoryIssue, Ids: orphanIds})
+	}
+	return report, nil
+}
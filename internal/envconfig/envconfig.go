@@ -0,0 +1,69 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package envconfig
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+)
+
+// ReadUint returns defaultValue when name is not set, zero is refused (it is reserved for the default).
+func ReadUint(logger *otelzap.Logger, name string, defaultValue uint64, bitSize int) uint64 {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		return defaultValue
+	}
+
+	value, err := strconv.ParseUint(valueStr, 10, bitSize)
+	if err != nil || value == 0 {
+		logger.Fatal("Failed to parse positive integer", zap.String("name", name), zap.String("value", valueStr))
+	}
+	return value
+}
+
+// ReadUintOrZero is ReadUint accepting zero, for settings where it disables a feature enabled by default.
+func ReadUintOrZero(logger *otelzap.Logger, name string, defaultValue uint64, bitSize int) uint64 {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		return defaultValue
+	}
+
+	value, err := strconv.ParseUint(valueStr, 10, bitSize)
+	if err != nil {
+		logger.Fatal("Failed to parse integer", zap.String("name", name), zap.String("value", valueStr))
+	}
+	return value
+}
+
+func ReadDuration(logger *otelzap.Logger, name string, defaultValue time.Duration) time.Duration {
+	valueStr := os.Getenv(name)
+	if valueStr == "" {
+		return defaultValue
+	}
+
+	value, err := time.ParseDuration(valueStr)
+	if err != nil || value <= 0 {
+		logger.Fatal("Failed to parse positive duration", zap.String("name", name), zap.String("value", valueStr))
+	}
+	return value
+}
@@ -0,0 +1,279 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package loginclient wraps the generated puzzleloginservice client with the defaults
+// every puzzle service needs : retries of the reads when the service is unavailable
+// and a memoization of the users returned by GetUsers. Concurrent GetUsers calls are coalesced :
+// an id already requested by another call is waited for instead of being requested again.
+package loginclient
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	pb "github.com/dvaumoron/puzzleloginservice"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultRetries      = 3
+	defaultBackoff      = 100 * time.Millisecond
+	defaultUserCacheTTL = time.Minute
+	defaultUserCacheMax = 10000
+)
+
+// the doubling stops there (a larger Backoff is kept as is)
+const maxBackoff = 5 * time.Second
+
+// Options zero values are replaced by the defaults, a negative Retries disables the retries,
+// a negative Backoff retries without waiting and a negative UserCacheTTL disables the memoization.
+type Options struct {
+	Retries      int
+	Backoff      time.Duration
+	UserCacheTTL time.Duration
+	UserCacheMax int
+}
+
+type userEntry struct {
+	user    *pb.User
+	expires time.Time
+}
+
+// userCall is closed once the request of its id is answered (user stays nil when it is unknown)
+type userCall struct {
+	done chan struct{}
+	user *pb.User
+	err  error
+}
+
+// Client is a drop-in pb.LoginClient, the methods it does not override are called directly.
+type Client struct {
+	pb.LoginClient
+	retries  int
+	backoff  time.Duration
+	cacheTTL time.Duration
+	cacheMax int
+	mutex    sync.Mutex
+	users    map[uint64]userEntry
+	pending  map[uint64]*userCall
+}
+
+func New(conn grpc.ClientConnInterface, options Options) *Client {
+	client := &Client{
+		LoginClient: pb.NewLoginClient(conn), retries: options.Retries, backoff: options.Backoff,
+		cacheTTL: options.UserCacheTTL, cacheMax: options.UserCacheMax, users: map[uint64]userEntry{},
+		pending: map[uint64]*userCall{},
+	}
+	if client.retries == 0 {
+		client.retries = defaultRetries
+	} else if client.retries < 0 {
+		client.retries = 0
+	}
+	if client.backoff == 0 {
+		client.backoff = defaultBackoff
+	} else if client.backoff < 0 {
+		client.backoff = 0
+	}
+	if client.cacheTTL == 0 {
+		client.cacheTTL = defaultUserCacheTTL
+	}
+	if client.cacheMax == 0 {
+		client.cacheMax = defaultUserCacheMax
+	}
+	return client
+}
+
+// only the ids missing from the memoization and not already requested by a concurrent call
+// are requested (once each), the returned users are copies, so callers can modify them.
+// A call waiting for the request of another one receives its error.
+func (c *Client) GetUsers(ctx context.Context, in *pb.UserIds, opts ...grpc.CallOption) (*pb.Users, error) {
+	found, missing, waited := c.claimUsers(in.Ids)
+	if len(missing) != 0 {
+		var response *pb.Users
+		err := c.retry(ctx, func() (err error) {
+			response, err = c.LoginClient.GetUsers(ctx, &pb.UserIds{Ids: missing}, opts...)
+			return err
+		})
+		if err != nil {
+			c.settleUsers(missing, nil, err)
+			return nil, err
+		}
+		c.settleUsers(missing, response.List, nil)
+		found = append(found, response.List...)
+	}
+
+	for _, call := range waited {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-call.done:
+		}
+		if call.err != nil {
+			return nil, call.err
+		}
+		if call.user != nil {
+			found = append(found, proto.Clone(call.user).(*pb.User))
+		}
+	}
+	return &pb.Users{List: found}, nil
+}
+
+func (c *Client) ListUsers(ctx context.Context, in *pb.RangeRequest, opts ...grpc.CallOption) (*pb.Users, error) {
+	var response *pb.Users
+	err := c.retry(ctx, func() (err error) {
+		response, err = c.LoginClient.ListUsers(ctx, in, opts...)
+		return err
+	})
+	return response, err
+}
+
+func (c *Client) ChangeLogin(ctx context.Context, in *pb.ChangeRequest, opts ...grpc.CallOption) (*pb.Response, error) {
+	response, err := c.LoginClient.ChangeLogin(ctx, in, opts...)
+	if err == nil && response.Success {
+		c.forget(in.UserId)
+	}
+	return response, err
+}
+
+func (c *Client) Delete(ctx context.Context, in *pb.UserId, opts ...grpc.CallOption) (*pb.Response, error) {
+	response, err := c.LoginClient.Delete(ctx, in, opts...)
+	if err == nil && response.Success {
+		c.forget(in.Id)
+	}
+	return response, err
+}
+
+// ShouldRetryLater is true when the service refused the call (overloaded hashing).
+func ShouldRetryLater(err error) bool {
+	return status.Code(err) == codes.ResourceExhausted
+}
+
+// TimedOut is true when the call or its handling took longer than allowed.
+func TimedOut(err error) bool {
+	return status.Code(err) == codes.DeadlineExceeded || errors.Is(err, context.DeadlineExceeded)
+}
+
+// writes are never retried, the call could have been handled before the connection failed
+func (c *Client) retry(ctx context.Context, call func() error) error {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		err := call()
+		if err == nil || attempt == c.retries || status.Code(err) != codes.Unavailable {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff < maxBackoff {
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+}
+
+// the missing ids are registered as pending, settleUsers must be called with them
+func (c *Client) claimUsers(ids []uint64) ([]*pb.User, []uint64, []*userCall) {
+	found := make([]*pb.User, 0, len(ids))
+	missing := make([]uint64, 0, len(ids))
+	var waited []*userCall
+	seen := make(map[uint64]struct{}, len(ids))
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+
+		if entry, ok := c.users[id]; ok && now.Before(entry.expires) {
+			found = append(found, proto.Clone(entry.user).(*pb.User))
+		} else if call, ok := c.pending[id]; ok {
+			waited = append(waited, call)
+		} else {
+			c.pending[id] = &userCall{done: make(chan struct{})}
+			missing = append(missing, id)
+		}
+	}
+	return found, missing, waited
+}
+
+// answers the calls waiting for ids, then memoizes the users when the request succeeded
+func (c *Client) settleUsers(ids []uint64, users []*pb.User, err error) {
+	byId := make(map[uint64]*pb.User, len(users))
+	for _, user := range users {
+		byId[user.Id] = user
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, id := range ids {
+		if call, ok := c.pending[id]; ok {
+			delete(c.pending, id)
+			call.user, call.err = byId[id], err
+			close(call.done)
+		}
+	}
+	if err == nil {
+		c.storeUsers(users)
+	}
+}
+
+// the caller holds the mutex
+func (c *Client) storeUsers(users []*pb.User) {
+	if c.cacheTTL < 0 {
+		return
+	}
+
+	now := time.Now()
+
+	if len(c.users)+len(users) > c.cacheMax {
+		for id, entry := range c.users {
+			if !now.Before(entry.expires) {
+				delete(c.users, id)
+			}
+		}
+		if len(c.users)+len(users) > c.cacheMax {
+			c.users = map[uint64]userEntry{}
+		}
+	}
+	expires := now.Add(c.cacheTTL)
+	for _, user := range users {
+		c.users[user.Id] = userEntry{user: proto.Clone(user).(*pb.User), expires: expires}
+	}
+}
+
+func (c *Client) forget(id uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.users, id)
+}
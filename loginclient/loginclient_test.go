@@ -0,0 +1,213 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginclient
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	pb "github.com/dvaumoron/puzzleloginservice"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeLoginClient struct {
+	pb.LoginClient
+	calls int
+}
+
+func (f *fakeLoginClient) GetUsers(ctx context.Context, in *pb.UserIds, opts ...grpc.CallOption) (*pb.Users, error) {
+	f.calls++
+	users := make([]*pb.User, 0, len(in.Ids))
+	for _, id := range in.Ids {
+		users = append(users, &pb.User{Id: id, Login: "user"})
+	}
+	return &pb.Users{List: users}, nil
+}
+
+func TestRetry(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	invalid := status.Error(codes.InvalidArgument, "invalid")
+	cases := []struct {
+		name      string
+		retries   int
+		failures  []error
+		wantCalls int
+		wantErr   error
+	}{
+		{"success", 3, nil, 1, nil},
+		{"recovered", 3, []error{unavailable, unavailable}, 3, nil},
+		{"exhausted", 2, []error{unavailable, unavailable, unavailable, unavailable}, 3, unavailable},
+		{"not retryable", 3, []error{invalid}, 1, invalid},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := &Client{retries: c.retries, backoff: time.Millisecond}
+			calls := 0
+			err := client.retry(context.Background(), func() error {
+				calls++
+				if calls <= len(c.failures) {
+					return c.failures[calls-1]
+				}
+				return nil
+			})
+			if err != c.wantErr {
+				t.Errorf("retry() = %v, want %v", err, c.wantErr)
+			}
+			if calls != c.wantCalls {
+				t.Errorf("got %d calls, want %d", calls, c.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	client := &Client{retries: 3, backoff: time.Hour}
+	calls := 0
+	err := client.retry(ctx, func() error {
+		calls++
+		return status.Error(codes.Unavailable, "unavailable")
+	})
+	if status.Code(err) != codes.Unavailable || calls != 1 {
+		t.Errorf("retry() = %v after %d calls, want the first error", err, calls)
+	}
+}
+
+func TestNewRetries(t *testing.T) {
+	cases := []struct {
+		retries int
+		want    int
+	}{
+		{0, defaultRetries},
+		{-1, 0},
+		{5, 5},
+	}
+	for _, c := range cases {
+		if got := New(nil, Options{Retries: c.retries}).retries; got != c.want {
+			t.Errorf("New(Retries: %d).retries = %d, want %d", c.retries, got, c.want)
+		}
+	}
+}
+
+func TestNewBackoff(t *testing.T) {
+	cases := []struct {
+		backoff time.Duration
+		want    time.Duration
+	}{
+		{0, defaultBackoff},
+		{-time.Second, 0},
+		{time.Second, time.Second},
+	}
+	for _, c := range cases {
+		if got := New(nil, Options{Backoff: c.backoff}).backoff; got != c.want {
+			t.Errorf("New(Backoff: %v).backoff = %v, want %v", c.backoff, got, c.want)
+		}
+	}
+}
+
+// blockingLoginClient holds the requests containing id 1 until release is closed
+type blockingLoginClient struct {
+	pb.LoginClient
+	requested chan []uint64
+	release   chan struct{}
+}
+
+func (b *blockingLoginClient) GetUsers(ctx context.Context, in *pb.UserIds, opts ...grpc.CallOption) (*pb.Users, error) {
+	b.requested <- in.Ids
+	for _, id := range in.Ids {
+		if id == 1 {
+			<-b.release
+		}
+	}
+	users := make([]*pb.User, 0, len(in.Ids))
+	for _, id := range in.Ids {
+		users = append(users, &pb.User{Id: id, Login: "user"})
+	}
+	return &pb.Users{List: users}, nil
+}
+
+func TestGetUsersCoalesced(t *testing.T) {
+	fake := &blockingLoginClient{requested: make(chan []uint64, 2), release: make(chan struct{})}
+	client := New(nil, Options{})
+	client.LoginClient = fake
+	ctx := context.Background()
+
+	firstDone := make(chan error)
+	go func() {
+		_, err := client.GetUsers(ctx, &pb.UserIds{Ids: []uint64{1, 2}})
+		firstDone <- err
+	}()
+	<-fake.requested
+
+	type result struct {
+		response *pb.Users
+		err      error
+	}
+	secondDone := make(chan result)
+	go func() {
+		response, err := client.GetUsers(ctx, &pb.UserIds{Ids: []uint64{2, 3}})
+		secondDone <- result{response, err}
+	}()
+	// the second call claims its ids before requesting the one not already pending
+	if ids := <-fake.requested; len(ids) != 1 || ids[0] != 3 {
+		t.Errorf("second call requested %v, want [3]", ids)
+	}
+	close(fake.release)
+
+	if err := <-firstDone; err != nil {
+		t.Fatalf("first GetUsers() failed: %v", err)
+	}
+	second := <-secondDone
+	if second.err != nil {
+		t.Fatalf("second GetUsers() failed: %v", second.err)
+	}
+	var ids []uint64
+	for _, user := range second.response.List {
+		ids = append(ids, user.Id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) != 2 || ids[0] != 2 || ids[1] != 3 {
+		t.Errorf("second GetUsers() returned ids %v, want [2 3]", ids)
+	}
+}
+
+func TestGetUsersCopies(t *testing.T) {
+	fake := &fakeLoginClient{}
+	client := New(nil, Options{})
+	client.LoginClient = fake
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		response, err := client.GetUsers(ctx, &pb.UserIds{Ids: []uint64{1}})
+		if err != nil {
+			t.Fatalf("GetUsers() failed: %v", err)
+		}
+		if login := response.List[0].Login; login != "user" {
+			t.Fatalf("GetUsers() login = %q after a caller modification", login)
+		}
+		response.List[0].Login = "modified"
+	}
+	if fake.calls != 1 {
+		t.Errorf("got %d calls, want 1", fake.calls)
+	}
+}
@@ -0,0 +1,62 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+)
+
+const alertMsg = "Security alert"
+
+type securityAlert struct {
+	Kind      string         `json:"kind"`
+	At        time.Time      `json:"at"`
+	RequestId string         `json:"requestId,omitempty"`
+	Details   map[string]any `json:"details"`
+}
+
+// alerter logs security alerts and posts them to ALERT_WEBHOOK_URL when set
+type alerter struct {
+	hook   webhook
+	logger *otelzap.Logger
+}
+
+func newAlerter(logger *otelzap.Logger) alerter {
+	return alerter{hook: newWebhook(os.Getenv("ALERT_WEBHOOK_URL"), alertWebhookOperation, logger), logger: logger}
+}
+
+// the webhook call does not delay the request which raised the alert
+func (a alerter) raise(ctx context.Context, alert securityAlert) {
+	alert.RequestId = RequestId(ctx)
+	fields := make([]zap.Field, 0, len(alert.Details)+1)
+	fields = append(fields, zap.String("kind", alert.Kind))
+	for key, value := range alert.Details {
+		fields = append(fields, zap.Any(key, value))
+	}
+	requestLogger(a.logger, ctx).Warn(alertMsg, fields...)
+
+	if a.hook.url != "" {
+		go a.hook.post(alert)
+	}
+}
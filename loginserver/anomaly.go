@@ -0,0 +1,110 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/dvaumoron/puzzleloginserver/internal/envconfig"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+)
+
+const loginAnomalyAlert = "login_anomaly"
+
+// values of the last complete window, exposed with the other debug variables
+// (the distinct targets stop being counted at ANOMALY_UNIQUE_TARGETS)
+var (
+	verifyAttempts      = expvar.NewInt("verifyAttempts")
+	verifyFailures      = expvar.NewInt("verifyFailures")
+	verifyUniqueTargets = expvar.NewInt("verifyUniqueTargets")
+)
+
+// anomalyMonitor counts Verify outcomes over fixed windows and raises an alert (once per window)
+// when the failure rate or the number of distinct failing logins goes over its threshold.
+type anomalyMonitor struct {
+	mutex          sync.Mutex
+	clock          Clock
+	alerter        alerter
+	window         time.Duration
+	minAttempts    int
+	failurePercent int
+	uniqueTargets  int
+	windowStart    time.Time
+	attempts       int
+	failures       int
+	targets        map[string]struct{}
+	alerted        bool
+}
+
+func newAnomalyMonitor(clock Clock, alerter alerter, logger *otelzap.Logger) *anomalyMonitor {
+	return &anomalyMonitor{
+		clock:          clock,
+		alerter:        alerter,
+		window:         envconfig.ReadDuration(logger, "ANOMALY_WINDOW", time.Minute),
+		minAttempts:    int(envconfig.ReadUint(logger, "ANOMALY_MIN_ATTEMPTS", 100, 32)),
+		failurePercent: int(envconfig.ReadUint(logger, "ANOMALY_FAILURE_PERCENT", 50, 8)),
+		uniqueTargets:  int(envconfig.ReadUint(logger, "ANOMALY_UNIQUE_TARGETS", 50, 32)),
+		windowStart:    clock.Now(),
+		targets:        map[string]struct{}{},
+	}
+}
+
+func (m *anomalyMonitor) record(ctx context.Context, login string, success bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.clock.Now()
+	if now.Sub(m.windowStart) >= m.window {
+		m.publish()
+		m.windowStart = now
+		m.attempts, m.failures = 0, 0
+		m.targets = map[string]struct{}{}
+		m.alerted = false
+	}
+
+	m.attempts++
+	if !success {
+		m.failures++
+		// reaching the threshold is all the alert needs, memory stays bounded under a flood of logins
+		if len(m.targets) < m.uniqueTargets {
+			m.targets[login] = struct{}{}
+		}
+	}
+
+	if m.alerted || m.attempts < m.minAttempts {
+		return
+	}
+	failurePercent := m.failures * 100 / m.attempts
+	if failurePercent >= m.failurePercent || len(m.targets) >= m.uniqueTargets {
+		m.alerted = true
+		m.alerter.raise(ctx, securityAlert{Kind: loginAnomalyAlert, At: now, Details: map[string]any{
+			"windowStart": m.windowStart, "attempts": m.attempts, "failures": m.failures,
+			"failurePercent": failurePercent, "uniqueTargets": len(m.targets),
+		}})
+	}
+}
+
+func (m *anomalyMonitor) publish() {
+	verifyAttempts.Set(int64(m.attempts))
+	verifyFailures.Set(int64(m.failures))
+	verifyUniqueTargets.Set(int64(len(m.targets)))
+}
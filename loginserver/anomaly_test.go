@@ -0,0 +1,82 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestAnomalyMonitor(t *testing.T) {
+	type outcomes struct {
+		successes int
+		// each failure targets a new login unless sameTarget
+		failures   int
+		sameTarget bool
+	}
+	cases := []struct {
+		name       string
+		windows    []outcomes
+		wantAlerts int
+	}{
+		{"below min attempts", []outcomes{{0, 9, true}}, 0},
+		{"low failure rate", []outcomes{{8, 2, true}}, 0},
+		{"failure rate", []outcomes{{5, 5, true}}, 1},
+		{"unique targets", []outcomes{{20, 4, false}}, 1},
+		{"once per window", []outcomes{{0, 30, false}}, 1},
+		{"each window", []outcomes{{0, 10, true}, {0, 10, true}}, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			core, logs := observer.New(zap.WarnLevel)
+			clock := newTestClock()
+			monitor := &anomalyMonitor{
+				clock: clock, alerter: newAlerter(otelzap.New(zap.New(core))), window: time.Minute,
+				minAttempts: 10, failurePercent: 50, uniqueTargets: 4, windowStart: clock.Now(), targets: map[string]struct{}{},
+			}
+			ctx := context.Background()
+			for _, window := range c.windows {
+				for index := 0; index < window.successes; index++ {
+					monitor.record(ctx, "user", true)
+				}
+				for index := 0; index < window.failures; index++ {
+					login := "target"
+					if !window.sameTarget {
+						login += strconv.Itoa(index)
+					}
+					monitor.record(ctx, login, false)
+				}
+				if len(monitor.targets) > monitor.uniqueTargets {
+					t.Errorf("kept %d targets, want at most %d", len(monitor.targets), monitor.uniqueTargets)
+				}
+				clock.advance(time.Minute)
+			}
+
+			if got := logs.FilterMessage(alertMsg).Len(); got != c.wantAlerts {
+				t.Errorf("got %d alerts, want %d", got, c.wantAlerts)
+			}
+		})
+	}
+}
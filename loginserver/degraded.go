@@ -0,0 +1,37 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import "expvar"
+
+const (
+	throttleResetOperation = "throttleReset"
+	rehashOperation        = "rehash"
+	historyForgetOperation = "historyForget"
+	alertWebhookOperation  = "alertWebhook"
+	notifyWebhookOperation = "notifyWebhook"
+)
+
+// failure counts of the optional operations, the requests are still served meanwhile,
+// a growing count tells operators some features are reduced
+var degradedOperations = expvar.NewMap("degradedOperations")
+
+func degraded(operation string) {
+	degradedOperations.Add(operation, 1)
+}
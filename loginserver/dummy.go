@@ -0,0 +1,54 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	mathrand "math/rand"
+
+	"github.com/dvaumoron/puzzleloginserver/hasher"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+)
+
+// dummyHashes are produced by the active hasher at startup, comparing an unknown login
+// against one of them costs as much as a real verification.
+type dummyHashes []string
+
+func makeDummyHashes(h hasher.Hasher, size int, logger *otelzap.Logger) dummyHashes {
+	dummies := make(dummyHashes, 0, size)
+	var secret [64]byte
+	for i := 0; i < size; i++ {
+		rand.Read(secret[:])
+		hashed, err := h.Hash(hex.EncodeToString(secret[:]))
+		if err != nil {
+			logger.Fatal("Failed to create dummy hash", zap.Error(err))
+		}
+		dummies = append(dummies, hashed)
+	}
+	return dummies
+}
+
+// the result is ignored, only the elapsed time matters,
+// but the error is returned so a saturated hasher answers the same way for unknown logins
+func (d dummyHashes) compare(h hasher.Hasher, salted string) error {
+	_, err := h.Compare(d[mathrand.Intn(len(d))], salted)
+	return err
+}
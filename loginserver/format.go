@@ -0,0 +1,68 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dvaumoron/puzzleloginserver/model"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const dataFormatName = "data_format"
+
+// to increment when stored values change in a way older releases can not read
+// (1 : prefixed hash schemes and pepper wrapping)
+const dataFormatVersion = 1
+
+// refuse to run against data written by a newer release (a rollback would silently corrupt it),
+// otherwise record the current version
+func checkDataFormat(db *gorm.DB, logger *otelzap.Logger) {
+	if err := db.AutoMigrate(&model.Metadata{}); err != nil {
+		logger.Fatal("Failed to create metadata table", zap.Error(err))
+	}
+
+	var format model.Metadata
+	err := db.First(&format, "name = ?", dataFormatName).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		logger.Fatal("Failed to read data format version", zap.Error(err))
+	}
+	if err == nil {
+		stored, err := strconv.ParseUint(format.Value, 10, 32)
+		if err != nil {
+			logger.Fatal("Failed to parse data format version", zap.String("value", format.Value), zap.Error(err))
+		}
+		if stored > dataFormatVersion {
+			logger.Fatal("Data written by a newer release, refusing to start",
+				zap.Uint64("stored", stored), zap.Int("supported", dataFormatVersion),
+			)
+		}
+		if stored == dataFormatVersion {
+			return
+		}
+	}
+
+	format = model.Metadata{Name: dataFormatName, Value: strconv.Itoa(dataFormatVersion)}
+	if err = db.Save(&format).Error; err != nil {
+		logger.Fatal("Failed to record data format version", zap.Error(err))
+	}
+}
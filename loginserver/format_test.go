@@ -0,0 +1,77 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/dvaumoron/puzzleloginserver/model"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestCheckDataFormat(t *testing.T) {
+	cases := []struct {
+		name      string
+		stored    string
+		wantFatal bool
+	}{
+		{"fresh database", "", false},
+		{"older release", "0", false},
+		{"same release", strconv.Itoa(dataFormatVersion), false},
+		{"newer release", strconv.Itoa(dataFormatVersion + 1), true},
+		{"unreadable version", "x", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db := testDB(t, &model.Metadata{})
+			if c.stored != "" {
+				if err := db.Create(&model.Metadata{Name: dataFormatName, Value: c.stored}).Error; err != nil {
+					t.Fatalf("Failed to store version: %v", err)
+				}
+			}
+
+			// Fatal panics instead of exiting
+			logger := otelzap.New(zap.NewNop().WithOptions(zap.WithFatalHook(zapcore.WriteThenPanic)))
+			fatal := func() (fatal bool) {
+				defer func() {
+					fatal = recover() != nil
+				}()
+				checkDataFormat(db, logger)
+				return false
+			}()
+			if fatal != c.wantFatal {
+				t.Fatalf("checkDataFormat() fatal = %v, want %v", fatal, c.wantFatal)
+			}
+			if fatal {
+				return
+			}
+
+			var format model.Metadata
+			if err := db.First(&format, "name = ?", dataFormatName).Error; err != nil {
+				t.Fatalf("Failed to read version: %v", err)
+			}
+			if format.Value != strconv.Itoa(dataFormatVersion) {
+				t.Errorf("stored version = %s, want %d", format.Value, dataFormatVersion)
+			}
+		})
+	}
+}
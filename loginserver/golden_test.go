@@ -0,0 +1,147 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dvaumoron/puzzleloginserver/hasher"
+	pb "github.com/dvaumoron/puzzleloginservice"
+	"google.golang.org/protobuf/proto"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files with the current responses")
+
+// hexadecimal SHA-512 like the clients send
+func goldenSalted(login string, password string) string {
+	digest := sha512.Sum512([]byte(login + password))
+	return hex.EncodeToString(digest[:])
+}
+
+// each step appends the exact serialized response (or the error) to the golden file,
+// a change of wire behavior shows as a diff of these lines
+func TestGoldenResponses(t *testing.T) {
+	logger := testLogger()
+	s := New(testDB(t), hasher.Migrating{Current: hasher.SHA512Compat{}}, LogNotifier(logger), newTestClock(), logger)
+	ctx := context.Background()
+	steps := []struct {
+		name string
+		call func() (proto.Message, error)
+	}{
+		{"register", func() (proto.Message, error) {
+			return s.Register(ctx, &pb.LoginRequest{Login: "alice", Salted: goldenSalted("alice", "secret")})
+		}},
+		{"register_second", func() (proto.Message, error) {
+			return s.Register(ctx, &pb.LoginRequest{Login: "bob", Salted: goldenSalted("bob", "secret")})
+		}},
+		{"register_used_login", func() (proto.Message, error) {
+			return s.Register(ctx, &pb.LoginRequest{Login: "alice", Salted: goldenSalted("alice", "other")})
+		}},
+		{"register_empty_login", func() (proto.Message, error) {
+			return s.Register(ctx, &pb.LoginRequest{Salted: goldenSalted("", "secret")})
+		}},
+		{"register_not_digest", func() (proto.Message, error) {
+			return s.Register(ctx, &pb.LoginRequest{Login: "carol", Salted: "secret"})
+		}},
+		{"verify", func() (proto.Message, error) {
+			return s.Verify(ctx, &pb.LoginRequest{Login: "alice", Salted: goldenSalted("alice", "secret")})
+		}},
+		{"verify_wrong_password", func() (proto.Message, error) {
+			return s.Verify(ctx, &pb.LoginRequest{Login: "alice", Salted: goldenSalted("alice", "wrong")})
+		}},
+		{"verify_unknown_login", func() (proto.Message, error) {
+			return s.Verify(ctx, &pb.LoginRequest{Login: "nobody", Salted: goldenSalted("nobody", "secret")})
+		}},
+		{"change_password", func() (proto.Message, error) {
+			return s.ChangePassword(ctx, &pb.ChangeRequest{
+				UserId: 1, OldSalted: goldenSalted("alice", "secret"), NewSalted: goldenSalted("alice", "new"),
+			})
+		}},
+		{"change_password_wrong_old", func() (proto.Message, error) {
+			return s.ChangePassword(ctx, &pb.ChangeRequest{
+				UserId: 1, OldSalted: goldenSalted("alice", "secret"), NewSalted: goldenSalted("alice", "other"),
+			})
+		}},
+		{"change_login", func() (proto.Message, error) {
+			return s.ChangeLogin(ctx, &pb.ChangeRequest{
+				UserId: 1, NewLogin: "alicia", OldSalted: goldenSalted("alice", "new"), NewSalted: goldenSalted("alicia", "new"),
+			})
+		}},
+		{"change_login_used", func() (proto.Message, error) {
+			return s.ChangeLogin(ctx, &pb.ChangeRequest{
+				UserId: 1, NewLogin: "bob", OldSalted: goldenSalted("alicia", "new"), NewSalted: goldenSalted("bob", "new"),
+			})
+		}},
+		{"get_users", func() (proto.Message, error) {
+			return s.GetUsers(ctx, &pb.UserIds{Ids: []uint64{2, 1, 9}})
+		}},
+		{"list_users", func() (proto.Message, error) {
+			return s.ListUsers(ctx, &pb.RangeRequest{Start: 0, End: 10})
+		}},
+		{"list_users_filtered", func() (proto.Message, error) {
+			return s.ListUsers(ctx, &pb.RangeRequest{Start: 0, End: 10, Filter: "ali"})
+		}},
+		{"delete", func() (proto.Message, error) {
+			return s.Delete(ctx, &pb.UserId{Id: 2})
+		}},
+		{"list_users_after_delete", func() (proto.Message, error) {
+			return s.ListUsers(ctx, &pb.RangeRequest{Start: 0, End: 10})
+		}},
+	}
+
+	var lines []string
+	for _, step := range steps {
+		response, err := step.call()
+		line := step.name + "="
+		if err != nil {
+			line += "error: " + err.Error()
+		} else {
+			encoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(response)
+			if err != nil {
+				t.Fatalf("Failed to marshal %s response: %v", step.name, err)
+			}
+			line += hex.EncodeToString(encoded)
+		}
+		lines = append(lines, line)
+	}
+	got := strings.Join(lines, "\n") + "\n"
+
+	path := filepath.Join("testdata", "responses.golden")
+	if *updateGolden {
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatalf("Failed to write golden file: %v", err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read golden file (run with -update to create it): %v", err)
+	}
+	if got != string(want) {
+		t.Errorf("responses differ from %s:\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
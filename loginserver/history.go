@@ -0,0 +1,95 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"time"
+
+	"github.com/dvaumoron/puzzleloginserver/internal/envconfig"
+	"github.com/dvaumoron/puzzleloginserver/model"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const historyPurgePeriod = time.Hour
+
+// passwordHistory keeps the last size replaced passwords of each user (size zero disables it),
+// entries older than maxAge (when set) are purged in background.
+type passwordHistory struct {
+	db     *gorm.DB
+	clock  Clock
+	size   int
+	maxAge time.Duration
+}
+
+func newPasswordHistory(db *gorm.DB, clock Clock, logger *otelzap.Logger) passwordHistory {
+	h := passwordHistory{
+		db:     db,
+		clock:  clock,
+		size:   int(envconfig.ReadUint(logger, "PASSWORD_HISTORY_SIZE", 0, 16)),
+		maxAge: envconfig.ReadDuration(logger, "PASSWORD_HISTORY_MAX_AGE", 0),
+	}
+	if h.size != 0 && h.maxAge != 0 {
+		go h.purge(logger)
+	}
+	return h
+}
+
+func (h passwordHistory) previous(ctx context.Context, userId uint64) ([]string, error) {
+	if h.size == 0 {
+		return nil, nil
+	}
+
+	var hashes []string
+	err := h.db.WithContext(ctx).Model(&model.PasswordHistory{}).Where("user_id = ?", userId).Order("id desc").Limit(h.size).Pluck("password", &hashes).Error
+	return hashes, err
+}
+
+// record the replaced hash and trim the entries beyond size, in the transaction changing the password
+func (h passwordHistory) push(tx *gorm.DB, userId uint64, replaced string) error {
+	if h.size == 0 {
+		return nil
+	}
+
+	if err := tx.Create(&model.PasswordHistory{UserID: userId, Password: replaced}).Error; err != nil {
+		return err
+	}
+
+	var keptIds []uint64
+	err := tx.Model(&model.PasswordHistory{}).Where("user_id = ?", userId).Order("id desc").Limit(h.size).Pluck("id", &keptIds).Error
+	if err != nil {
+		return err
+	}
+	return tx.Where("user_id = ? AND id NOT IN ?", userId, keptIds).Delete(&model.PasswordHistory{}).Error
+}
+
+func (h passwordHistory) forget(ctx context.Context, userId uint64) error {
+	return h.db.WithContext(ctx).Where("user_id = ?", userId).Delete(&model.PasswordHistory{}).Error
+}
+
+func (h passwordHistory) purge(logger *otelzap.Logger) {
+	for range time.Tick(historyPurgePeriod) {
+		err := h.db.Where("created_at < ?", h.clock.Now().Add(-h.maxAge)).Delete(&model.PasswordHistory{}).Error
+		if err != nil {
+			logger.Warn("Failed to purge password history", zap.Error(err))
+		}
+	}
+}
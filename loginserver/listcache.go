@@ -0,0 +1,124 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/dvaumoron/puzzleloginserver/internal/envconfig"
+	pb "github.com/dvaumoron/puzzleloginservice"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+)
+
+var (
+	listCacheHits   = expvar.NewInt("listCacheHits")
+	listCacheMisses = expvar.NewInt("listCacheMisses")
+)
+
+// the order is always by login, so the range and the filter are enough
+type listKey struct {
+	filter string
+	start  uint64
+	end    uint64
+}
+
+type listEntry struct {
+	users   *pb.Users
+	expires time.Time
+}
+
+// listCache keeps ListUsers results for a short time, any user mutation on this instance clears it
+// (other instances are only covered by the ttl). A nil listCache disables caching.
+type listCache struct {
+	mutex      sync.Mutex
+	clock      Clock
+	ttl        time.Duration
+	maxSize    int
+	entries    map[listKey]listEntry
+	generation uint64
+}
+
+func newListCache(clock Clock, logger *otelzap.Logger) *listCache {
+	ttl := envconfig.ReadDuration(logger, "LIST_CACHE_TTL", 0)
+	if ttl == 0 {
+		return nil
+	}
+
+	maxSize := int(envconfig.ReadUint(logger, "LIST_CACHE_SIZE", 1000, 32))
+	return &listCache{clock: clock, ttl: ttl, maxSize: maxSize, entries: map[listKey]listEntry{}}
+}
+
+// the returned generation must be given back to put
+func (c *listCache) get(key listKey) (*pb.Users, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[key]
+	if ok && c.clock.Now().Before(entry.expires) {
+		listCacheHits.Add(1)
+		return entry.users, c.generation, true
+	}
+	listCacheMisses.Add(1)
+	return nil, c.generation, false
+}
+
+// a result read while a mutation happened is not kept
+func (c *listCache) put(key listKey, generation uint64, users *pb.Users) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	now := c.clock.Now()
+	if len(c.entries) >= c.maxSize {
+		for entryKey, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, entryKey)
+			}
+		}
+		if len(c.entries) >= c.maxSize {
+			c.entries = map[listKey]listEntry{}
+		}
+	}
+	c.entries[key] = listEntry{users: users, expires: now.Add(c.ttl)}
+}
+
+func (c *listCache) invalidate() {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries = map[listKey]listEntry{}
+	c.generation++
+}
@@ -0,0 +1,88 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/dvaumoron/puzzleloginservice"
+)
+
+func TestListCache(t *testing.T) {
+	key := listKey{filter: "a", start: 0, end: 10}
+	other := listKey{filter: "b", start: 0, end: 10}
+	users := &pb.Users{Total: 1, List: []*pb.User{{Id: 1, Login: "a"}}}
+	cases := []struct {
+		name string
+		// run between the get and the put of key
+		between func(c *listCache, clock *testClock)
+		// run after the put of key
+		after  func(c *listCache, clock *testClock)
+		wantOk bool
+	}{
+		{"hit", nil, nil, true},
+		{"expired", nil, func(c *listCache, clock *testClock) { clock.advance(time.Minute) }, false},
+		{"invalidated", nil, func(c *listCache, clock *testClock) { c.invalidate() }, false},
+		{"mutated while read", func(c *listCache, clock *testClock) { c.invalidate() }, nil, false},
+		{"other result kept", func(c *listCache, clock *testClock) {
+			_, generation, _ := c.get(other)
+			c.put(other, generation, users)
+		}, nil, true},
+		{"full", nil, func(c *listCache, clock *testClock) {
+			_, generation, _ := c.get(other)
+			c.put(other, generation, users)
+			c.put(listKey{filter: "c"}, generation, users)
+		}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			clock := newTestClock()
+			cache := &listCache{clock: clock, ttl: time.Minute, maxSize: 2, entries: map[listKey]listEntry{}}
+			_, generation, ok := cache.get(key)
+			if ok {
+				t.Fatalf("get() hit an empty cache")
+			}
+			if c.between != nil {
+				c.between(cache, clock)
+			}
+			cache.put(key, generation, users)
+			if c.after != nil {
+				c.after(cache, clock)
+			}
+
+			cached, _, ok := cache.get(key)
+			if ok != c.wantOk {
+				t.Fatalf("get() = %v, want %v", ok, c.wantOk)
+			}
+			if ok && cached != users {
+				t.Errorf("get() returned another result")
+			}
+		})
+	}
+}
+
+func TestListCacheDisabled(t *testing.T) {
+	var cache *listCache
+	cache.put(listKey{}, 0, &pb.Users{})
+	cache.invalidate()
+	if _, _, ok := cache.get(listKey{}); ok {
+		t.Errorf("get() hit a nil cache")
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dvaumoron/puzzleloginserver/model"
+	pb "github.com/dvaumoron/puzzleloginservice"
+)
+
+func TestListUsers(t *testing.T) {
+	s := newTestServer(t)
+	for _, login := range []string{"carol", "alice", "bob", "alicia"} {
+		if err := s.db.Create(&model.User{Login: login, Password: "x"}).Error; err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	cases := []struct {
+		name       string
+		request    *pb.RangeRequest
+		wantLogins string
+		wantTotal  uint64
+	}{
+		{"all", &pb.RangeRequest{Start: 0, End: 10}, "alice,alicia,bob,carol", 4},
+		{"page", &pb.RangeRequest{Start: 1, End: 3}, "alicia,bob", 4},
+		{"filter", &pb.RangeRequest{Start: 0, End: 10, Filter: "ali"}, "alice,alicia", 2},
+		{"filtered page", &pb.RangeRequest{Start: 1, End: 10, Filter: "ali"}, "alicia", 2},
+		{"beyond total", &pb.RangeRequest{Start: 8, End: 10}, "", 4},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			users, err := s.ListUsers(context.Background(), c.request)
+			if err != nil {
+				t.Fatalf("ListUsers() failed: %v", err)
+			}
+
+			logins := ""
+			for index, user := range users.List {
+				if index != 0 {
+					logins += ","
+				}
+				logins += user.Login
+			}
+			if logins != c.wantLogins || users.Total != c.wantTotal {
+				t.Errorf("ListUsers() = %q (total %d), want %q (total %d)", logins, users.Total, c.wantLogins, c.wantTotal)
+			}
+		})
+	}
+}
+
+// the count and the page run concurrently, a failure of either fails the request
+func TestListUsersFailure(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.db.Migrator().DropTable(&model.User{}); err != nil {
+		t.Fatalf("Failed to drop users: %v", err)
+	}
+
+	if _, err := s.ListUsers(context.Background(), &pb.RangeRequest{Start: 0, End: 10}); err != errInternal {
+		t.Errorf("ListUsers() = %v, want %v", err, errInternal)
+	}
+}
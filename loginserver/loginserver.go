@@ -21,12 +21,17 @@ package loginserver
 import (
 	"context"
 	"errors"
+	"time"
 
 	dbclient "github.com/dvaumoron/puzzledbclient"
+	"github.com/dvaumoron/puzzleloginserver/hasher"
+	"github.com/dvaumoron/puzzleloginserver/internal/envconfig"
 	"github.com/dvaumoron/puzzleloginserver/model"
 	pb "github.com/dvaumoron/puzzleloginservice"
 	"github.com/uptrace/opentelemetry-go-extra/otelzap"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"gorm.io/gorm"
 )
 
@@ -34,49 +39,169 @@ const LoginKey = "puzzleLogin"
 
 const dbAccessMsg = "Failed to access database"
 
+const hashMsg = "Failed to hash password"
+
+const throttledMsg = "Attempt refused by throttling"
+
 var errInternal = errors.New("internal service error")
 
+var errOverloaded = status.Error(codes.ResourceExhausted, "too many pending verifications")
+
+var errInvalidSalted = status.Error(codes.InvalidArgument, "salted password is not a hexadecimal digest")
+
 // server is used to implement puzzleloginservice.LoginServer.
 type server struct {
 	pb.UnimplementedLoginServer
-	db     *gorm.DB
-	logger *otelzap.Logger
+	db       *gorm.DB
+	hasher   hasher.Hasher
+	dummies  dummyHashes
+	monitor  *anomalyMonitor
+	stuffing *stuffingDetector
+	lists    *listCache
+	users    *userBatcher
+	sources  sourceResolver
+	limiter  throttler
+	history  passwordHistory
+	notifier Notifier
+	// failures before a success making it suspicious
+	suspiciousFailures uint32
+	defaultRoles       []string
+	clock              Clock
+	logger             *otelzap.Logger
 }
 
-func New(db *gorm.DB, logger *otelzap.Logger) pb.LoginServer {
-	db.AutoMigrate(&model.User{})
-	return server{db: db, logger: logger}
+func New(db *gorm.DB, hasher hasher.Hasher, notifier Notifier, clock Clock, logger *otelzap.Logger) pb.LoginServer {
+	db.Config.NowFunc = func() time.Time {
+		return clock.Now().Local()
+	}
+	checkDataFormat(db, logger)
+	db.AutoMigrate(&model.User{}, &model.Throttle{}, &model.PasswordHistory{})
+	// at least one fake record, so unknown logins can not be told apart by the response time
+	dummies := makeDummyHashes(hasher, int(envconfig.ReadUint(logger, "DUMMY_HASH_POOL_SIZE", 1, 16)), logger)
+	alerter := newAlerter(logger)
+	sources := newSourceResolver(logger)
+	return server{
+		db: db, hasher: hasher, dummies: dummies, monitor: newAnomalyMonitor(clock, alerter, logger),
+		stuffing: newStuffingDetector(clock, alerter, logger), lists: newListCache(clock, logger), sources: sources,
+		users: newUserBatcher(db, logger), limiter: newThrottler(db, clock, sources, logger),
+		history: newPasswordHistory(db, clock, logger), notifier: notifier,
+		suspiciousFailures: uint32(envconfig.ReadUint(logger, "SUSPICIOUS_FAILURES", 3, 32)), defaultRoles: readDefaultRoles(),
+		clock: clock, logger: logger,
+	}
 }
 
 func (s server) Verify(ctx context.Context, request *pb.LoginRequest) (*pb.Response, error) {
-	logger := s.logger.Ctx(ctx)
+	logger := s.ctxLogger(ctx)
+	// a blocked source is refused before counting, its attempts do not lock out the logins it targets
+	if s.stuffing.blocked(s.sources.source(ctx)) {
+		return s.verifyRefused(ctx, logger, request.Login)
+	}
+
+	throttleKeys := s.limiter.keys(ctx, request.Login)
+	blocked, err := s.limiter.attempt(ctx, throttleKeys)
+	if err != nil {
+		logger.Error(dbAccessMsg, zap.Error(err))
+		return nil, errInternal
+	}
+	if blocked {
+		return s.verifyRefused(ctx, logger, request.Login)
+	}
+
 	var user model.User
-	err := s.db.First(&user, "login = ?", request.Login).Error
+	err = s.db.WithContext(ctx).First(&user, "login = ?", request.Login).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			// unknown user, return false (bool default)
-			return &pb.Response{}, nil
+			// unknown user, take the same time as a wrong password and return false (bool default)
+			if err = s.dummies.compare(s.ctxHasher(ctx), request.Salted); err != nil {
+				return nil, hashFailure(logger, err)
+			}
+			return s.verifyFailed(ctx, request.Login)
 		}
 
 		logger.Error(dbAccessMsg, zap.Error(err))
 		return nil, errInternal
 	}
 
-	if request.Salted != user.Password {
-		return &pb.Response{}, nil
+	same, err := s.ctxHasher(ctx).Compare(user.Password, request.Salted)
+	if err != nil {
+		return nil, hashFailure(logger, err)
+	}
+	if !same {
+		return s.verifyFailed(ctx, request.Login)
+	}
+
+	s.monitor.record(ctx, request.Login, true)
+	failures, err := s.limiter.succeed(ctx, throttleKeys)
+	if err != nil {
+		logger.Warn(dbAccessMsg, zap.Error(err))
+		degraded(throttleResetOperation)
+	}
+	if failures >= s.suspiciousFailures {
+		s.notifier.NotifySuspiciousLogin(ctx, SuspiciousLogin{
+			UserId: user.ID, Login: user.Login, Reason: FailuresBeforeSuccess, At: s.clock.Now(), Failures: failures,
+			RequestId: RequestId(ctx),
+		})
+	}
+
+	if s.hasher.NeedsRehash(user.Password) {
+		s.rehash(ctx, logger, user, request.Salted)
 	}
 	return &pb.Response{Success: true, Id: user.ID}, nil
 }
 
+// answered like a wrong password, clients only know about success,
+// and counted as a failure by the monitor (the failure rate does not drop while an attack is refused)
+func (s server) verifyRefused(ctx context.Context, logger otelzap.LoggerWithCtx, login string) (*pb.Response, error) {
+	logger.Info(throttledMsg)
+	s.monitor.record(ctx, login, false)
+	return &pb.Response{}, nil
+}
+
+// unknown login and wrong password are handled the same way (the attempt is already counted by the throttler)
+func (s server) verifyFailed(ctx context.Context, login string) (*pb.Response, error) {
+	s.monitor.record(ctx, login, false)
+	s.stuffing.recordFailure(ctx, s.sources.source(ctx), login)
+	return &pb.Response{}, nil
+}
+
+// the login succeeded, so failing to upgrade the stored hash is only logged
+func (s server) rehash(ctx context.Context, logger otelzap.LoggerWithCtx, user model.User, salted string) {
+	hashed, err := s.ctxHasher(ctx).Hash(salted)
+	if err != nil {
+		logger.Warn(hashMsg, zap.Error(err))
+		degraded(rehashOperation)
+		return
+	}
+
+	// a concurrent password change wins
+	err = s.db.WithContext(ctx).Model(&model.User{}).Where("id = ? AND password = ?", user.ID, user.Password).Update("password", hashed).Error
+	if err != nil {
+		logger.Warn(dbAccessMsg, zap.Error(err))
+		degraded(rehashOperation)
+	}
+}
+
 func (s server) Register(ctx context.Context, request *pb.LoginRequest) (*pb.Response, error) {
-	logger := s.logger.Ctx(ctx)
+	logger := s.ctxLogger(ctx)
+	db := s.db.WithContext(ctx)
 	login := request.Login
 	if login == "" {
 		return &pb.Response{}, nil
 	}
 
+	// every attempt counts, successful or not
+	blocked, err := s.limiter.attempt(ctx, s.limiter.registerKeys(ctx))
+	if err != nil {
+		logger.Error(dbAccessMsg, zap.Error(err))
+		return nil, errInternal
+	}
+	if blocked {
+		logger.Info(throttledMsg)
+		return &pb.Response{}, nil
+	}
+
 	var user model.User
-	err := s.db.First(&user, "login = ?", login).Error
+	err = db.First(&user, "login = ?", login).Error
 	if err == nil {
 		// login already used, return false (bool default)
 		return &pb.Response{}, nil
@@ -88,23 +213,33 @@ func (s server) Register(ctx context.Context, request *pb.LoginRequest) (*pb.Res
 	}
 
 	// unknown user, create new
-	user = model.User{Login: login, Password: request.Salted}
-	if err = s.db.Create(&user).Error; err != nil {
+	hashed, err := s.ctxHasher(ctx).Hash(request.Salted)
+	if err != nil {
+		return nil, hashFailure(logger, err)
+	}
+
+	user = model.User{Login: login, Password: hashed}
+	if err = db.Create(&user).Error; err != nil {
 		logger.Error(dbAccessMsg, zap.Error(err))
 		return nil, errInternal
 	}
+	s.lists.invalidate()
+	s.notifier.NotifyRegistered(ctx, UserRegistered{
+		UserId: user.ID, Login: user.Login, At: user.CreatedAt, DefaultRoles: s.defaultRoles, RequestId: RequestId(ctx),
+	})
 	return &pb.Response{Success: true, Id: user.ID}, nil
 }
 
 func (s server) ChangeLogin(ctx context.Context, request *pb.ChangeRequest) (*pb.Response, error) {
-	logger := s.logger.Ctx(ctx)
+	logger := s.ctxLogger(ctx)
+	db := s.db.WithContext(ctx)
 	newLogin := request.NewLogin
 	if newLogin == "" {
 		return &pb.Response{}, nil
 	}
 
 	var user model.User
-	err := s.db.First(&user, "id = ?", request.UserId).Error
+	err := db.First(&user, "id = ?", request.UserId).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			// unknown user, return false (bool default)
@@ -115,11 +250,30 @@ func (s server) ChangeLogin(ctx context.Context, request *pb.ChangeRequest) (*pb
 		return nil, errInternal
 	}
 
-	if request.OldSalted != user.Password {
+	same, err := s.ctxHasher(ctx).Compare(user.Password, request.OldSalted)
+	if err != nil {
+		return nil, hashFailure(logger, err)
+	}
+	if !same {
 		return &pb.Response{}, nil
 	}
 
-	err = s.db.First(&user, "login = ?", newLogin).Error
+	// the password is replaced too, it follows the same history rules as in ChangePassword
+	reused, err := s.reused(ctx, logger, user, request.NewSalted)
+	if err != nil {
+		return nil, err
+	}
+	if reused {
+		return &pb.Response{}, nil
+	}
+
+	hashed, err := s.ctxHasher(ctx).Hash(request.NewSalted)
+	if err != nil {
+		return nil, hashFailure(logger, err)
+	}
+
+	var other model.User
+	err = db.First(&other, "login = ?", newLogin).Error
 	if err == nil {
 		// login already used
 		return &pb.Response{}, nil
@@ -129,20 +283,33 @@ func (s server) ChangeLogin(ctx context.Context, request *pb.ChangeRequest) (*pb
 		return nil, errInternal
 	}
 
-	err = s.db.Model(&user).Updates(map[string]any{
-		"login": newLogin, "password": request.NewSalted,
-	}).Error
+	// Updates changes user.Password
+	replaced := user.Password
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&user).Updates(map[string]any{
+			"login": newLogin, "password": hashed,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return s.history.push(tx, user.ID, replaced)
+	})
 	if err != nil {
 		logger.Error(dbAccessMsg, zap.Error(err))
 		return nil, errInternal
 	}
+	s.lists.invalidate()
+	s.notifier.NotifyCredentialChanged(ctx, CredentialChanged{
+		UserId: request.UserId, Login: newLogin, Change: LoginChanged, At: s.clock.Now(), RequestId: RequestId(ctx),
+	})
 	return &pb.Response{Success: true}, nil
 }
 
 func (s server) ChangePassword(ctx context.Context, request *pb.ChangeRequest) (*pb.Response, error) {
-	logger := s.logger.Ctx(ctx)
+	logger := s.ctxLogger(ctx)
+	db := s.db.WithContext(ctx)
 	var user model.User
-	err := s.db.First(&user, "id = ?", request.UserId).Error
+	err := db.First(&user, "id = ?", request.UserId).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			// unknown user, return false (bool default)
@@ -153,20 +320,86 @@ func (s server) ChangePassword(ctx context.Context, request *pb.ChangeRequest) (
 		return nil, errInternal
 	}
 
-	if request.OldSalted != user.Password {
+	same, err := s.ctxHasher(ctx).Compare(user.Password, request.OldSalted)
+	if err != nil {
+		return nil, hashFailure(logger, err)
+	}
+	if !same {
+		return &pb.Response{}, nil
+	}
+
+	reused, err := s.reused(ctx, logger, user, request.NewSalted)
+	if err != nil {
+		return nil, err
+	}
+	if reused {
 		return &pb.Response{}, nil
 	}
-	if err = s.db.Model(&user).Update("password", request.NewSalted).Error; err != nil {
+
+	hashed, err := s.ctxHasher(ctx).Hash(request.NewSalted)
+	if err != nil {
+		return nil, hashFailure(logger, err)
+	}
+
+	// Update changes user.Password
+	replaced := user.Password
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Update("password", hashed).Error; err != nil {
+			return err
+		}
+		return s.history.push(tx, user.ID, replaced)
+	})
+	if err != nil {
 		logger.Error(dbAccessMsg, zap.Error(err))
 		return nil, errInternal
 	}
+	s.lists.invalidate()
+	s.notifier.NotifyCredentialChanged(ctx, CredentialChanged{
+		UserId: user.ID, Login: user.Login, Change: PasswordChanged, At: s.clock.Now(), RequestId: RequestId(ctx),
+	})
 	return &pb.Response{Success: true}, nil
 }
 
+// the current password can not be reused either (when a history is kept), history entries are never rehashed,
+// so the ones which can not be read anymore (like with a retired pepper) are not considered a match
+func (s server) reused(ctx context.Context, logger otelzap.LoggerWithCtx, user model.User, salted string) (bool, error) {
+	if s.history.size == 0 {
+		return false, nil
+	}
+
+	previous, err := s.history.previous(ctx, user.ID)
+	if err != nil {
+		logger.Error(dbAccessMsg, zap.Error(err))
+		return false, errInternal
+	}
+
+	same, err := s.ctxHasher(ctx).Compare(user.Password, salted)
+	if err != nil {
+		return false, hashFailure(logger, err)
+	}
+	if same {
+		return true, nil
+	}
+	for _, previousHash := range previous {
+		same, err = s.ctxHasher(ctx).Compare(previousHash, salted)
+		if err != nil {
+			if errors.Is(err, hasher.ErrUnknownPepper) || errors.Is(err, hasher.ErrMalformedHash) {
+				logger.Info("Unreadable password history entry", zap.Uint64("userId", user.ID), zap.Error(err))
+				continue
+			}
+			return false, hashFailure(logger, err)
+		}
+		if same {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (s server) GetUsers(ctx context.Context, request *pb.UserIds) (*pb.Users, error) {
-	logger := s.logger.Ctx(ctx)
-	var users []model.User
-	if err := s.db.Find(&users, "id IN ?", request.Ids).Error; err != nil {
+	logger := s.ctxLogger(ctx)
+	users, err := s.users.load(ctx, s.db.WithContext(ctx), request.Ids)
+	if err != nil {
 		logger.Error(dbAccessMsg, zap.Error(err))
 		return nil, errInternal
 	}
@@ -174,48 +407,101 @@ func (s server) GetUsers(ctx context.Context, request *pb.UserIds) (*pb.Users, e
 }
 
 func (s server) ListUsers(ctx context.Context, request *pb.RangeRequest) (*pb.Users, error) {
-	logger := s.logger.Ctx(ctx)
+	logger := s.ctxLogger(ctx)
 	filter := request.Filter
 	noFilter := filter == ""
 
-	userRequest := s.db.Model(&model.User{})
+	key := listKey{filter: filter, start: request.Start, end: request.End}
+	cached, generation, ok := s.lists.get(key)
+	if ok {
+		return cached, nil
+	}
+
 	if !noFilter {
 		filter = dbclient.BuildLikeFilter(filter)
-		userRequest.Where("login LIKE ?", filter)
 	}
+
+	// count and page are independent, the first failure cancels the other query
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	db := s.db.WithContext(ctx)
+
 	var total int64
-	err := userRequest.Count(&total).Error
-	if err != nil {
-		logger.Error(dbAccessMsg, zap.Error(err))
-		return nil, errInternal
-	}
-	if total == 0 {
-		return &pb.Users{}, nil
-	}
+	countDone := make(chan error, 1)
+	go func() {
+		userRequest := db.Model(&model.User{})
+		if !noFilter {
+			userRequest.Where("login LIKE ?", filter)
+		}
+		err := userRequest.Count(&total).Error
+		if err != nil {
+			cancel()
+		}
+		countDone <- err
+	}()
 
 	var users []model.User
-	page := dbclient.Paginate(s.db, request.Start, request.End).Order("login asc")
+	page := dbclient.Paginate(db, request.Start, request.End).Order("login asc")
+	var err error
 	if noFilter {
 		err = page.Find(&users).Error
 	} else {
 		err = page.Find(&users, "login LIKE ?", filter).Error
 	}
+	if err != nil {
+		cancel()
+	}
 
+	if countErr := <-countDone; countErr != nil && !errors.Is(countErr, context.Canceled) {
+		err = countErr
+	}
 	if err != nil {
 		logger.Error(dbAccessMsg, zap.Error(err))
 		return nil, errInternal
 	}
-	return &pb.Users{List: convertUsersFromModel(users), Total: uint64(total)}, nil
+	result := &pb.Users{List: convertUsersFromModel(users), Total: uint64(total)}
+	s.lists.put(key, generation, result)
+	return result, nil
 }
 
 func (s server) Delete(ctx context.Context, request *pb.UserId) (*pb.Response, error) {
-	if err := s.db.Delete(&model.User{}, request.Id).Error; err != nil {
-		s.logger.ErrorContext(ctx, dbAccessMsg, zap.Error(err))
+	if err := s.db.WithContext(ctx).Delete(&model.User{}, request.Id).Error; err != nil {
+		s.ctxLogger(ctx).Error(dbAccessMsg, zap.Error(err))
 		return nil, errInternal
 	}
+	if err := s.history.forget(ctx, request.Id); err != nil {
+		s.ctxLogger(ctx).Warn(dbAccessMsg, zap.Error(err))
+		degraded(historyForgetOperation)
+	}
+	s.lists.invalidate()
 	return &pb.Response{Success: true}, nil
 }
 
+// saturation is expected under load spikes, the caller can retry later,
+// a salted value which is not a digest is a mistake of the caller
+// the waiting for a hash slot needs the request context
+func (s server) ctxHasher(ctx context.Context) hasher.Hasher {
+	return hasher.WithContext(ctx, s.hasher)
+}
+
+func hashFailure(logger otelzap.LoggerWithCtx, err error) error {
+	if errors.Is(err, hasher.ErrOverloaded) {
+		logger.Warn(hashMsg, zap.Error(err))
+		return errOverloaded
+	}
+	if errors.Is(err, hasher.ErrInvalidSalted) {
+		logger.Info(hashMsg, zap.Error(err))
+		return errInvalidSalted
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		logger.Info(hashMsg, zap.Error(err))
+		return status.FromContextError(err).Err()
+	}
+
+	logger.Error(hashMsg, zap.Error(err))
+	return errInternal
+}
+
 func convertUsersFromModel(users []model.User) []*pb.User {
 	resUsers := make([]*pb.User, 0, len(users))
 	for _, user := range users {
@@ -0,0 +1,213 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dvaumoron/puzzleloginserver/hasher"
+	"github.com/dvaumoron/puzzleloginserver/model"
+	pb "github.com/dvaumoron/puzzleloginservice"
+	"github.com/glebarez/sqlite"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+type testClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2023, time.May, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func testLogger() *otelzap.Logger {
+	return otelzap.New(zap.NewNop())
+}
+
+// a file per test, an in-memory database would be distinct for each pooled connection
+func testDB(t *testing.T, models ...any) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "login.db")), &gorm.Config{
+		Logger: gormlogger.Default.LogMode(gormlogger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err = db.AutoMigrate(models...); err != nil {
+		t.Fatalf("Failed to create tables: %v", err)
+	}
+	return db
+}
+
+// env holds name and value pairs
+func newTestServer(t *testing.T, env ...string) server {
+	for index := 0; index+1 < len(env); index += 2 {
+		t.Setenv(env[index], env[index+1])
+	}
+	logger := testLogger()
+	return New(testDB(t), hasher.Migrating{Current: hasher.Bcrypt{Cost: 4}}, LogNotifier(logger), newTestClock(), logger).(server)
+}
+
+func TestChangePasswordHistory(t *testing.T) {
+	cases := []struct {
+		name        string
+		historySize string
+		// passwords successively set after the registration with "p0"
+		changes []string
+		reused  string
+		want    bool
+	}{
+		{"current without history", "", nil, "p0", true},
+		{"current", "2", nil, "p0", false},
+		{"previous", "2", []string{"p1"}, "p0", false},
+		{"oldest kept", "2", []string{"p1", "p2"}, "p0", false},
+		{"beyond history", "2", []string{"p1", "p2", "p3"}, "p0", true},
+		{"never used", "2", []string{"p1"}, "p2", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newTestServer(t, "PASSWORD_HISTORY_SIZE", c.historySize)
+			response, err := s.Register(ctx, &pb.LoginRequest{Login: "user", Salted: "p0"})
+			if err != nil || !response.Success {
+				t.Fatalf("Register() = %v, %v", response, err)
+			}
+
+			userId, current := response.Id, "p0"
+			for _, change := range c.changes {
+				response, err = s.ChangePassword(ctx, &pb.ChangeRequest{UserId: userId, OldSalted: current, NewSalted: change})
+				if err != nil || !response.Success {
+					t.Fatalf("ChangePassword(%s) = %v, %v", change, response, err)
+				}
+				current = change
+			}
+
+			response, err = s.ChangePassword(ctx, &pb.ChangeRequest{UserId: userId, OldSalted: current, NewSalted: c.reused})
+			if err != nil {
+				t.Fatalf("ChangePassword() failed: %v", err)
+			}
+			if response.Success != c.want {
+				t.Errorf("ChangePassword(%s).Success = %v, want %v", c.reused, response.Success, c.want)
+			}
+		})
+	}
+}
+
+func TestChangePasswordWrongOld(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, "PASSWORD_HISTORY_SIZE", "2")
+	response, err := s.Register(ctx, &pb.LoginRequest{Login: "user", Salted: "p0"})
+	if err != nil || !response.Success {
+		t.Fatalf("Register() = %v, %v", response, err)
+	}
+
+	response, err = s.ChangePassword(ctx, &pb.ChangeRequest{UserId: response.Id, OldSalted: "wrong", NewSalted: "p1"})
+	if err != nil || response.Success {
+		t.Errorf("ChangePassword() = %v, %v, want a refusal", response, err)
+	}
+}
+
+func TestChangeLoginHistory(t *testing.T) {
+	cases := []struct {
+		name     string
+		newLogin string
+		// new password of the ChangeLogin, then of a following ChangePassword
+		newSalted string
+		reused    string
+		wantLogin bool
+		want      bool
+	}{
+		{"current password", "other", "p0", "", false, false},
+		{"new password", "other", "p1", "p2", true, true},
+		{"replaced password recorded", "other", "p1", "p0", true, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newTestServer(t, "PASSWORD_HISTORY_SIZE", "2")
+			response, err := s.Register(ctx, &pb.LoginRequest{Login: "user", Salted: "p0"})
+			if err != nil || !response.Success {
+				t.Fatalf("Register() = %v, %v", response, err)
+			}
+
+			userId := response.Id
+			response, err = s.ChangeLogin(ctx, &pb.ChangeRequest{UserId: userId, NewLogin: c.newLogin, OldSalted: "p0", NewSalted: c.newSalted})
+			if err != nil {
+				t.Fatalf("ChangeLogin() failed: %v", err)
+			}
+			if response.Success != c.wantLogin {
+				t.Fatalf("ChangeLogin().Success = %v, want %v", response.Success, c.wantLogin)
+			}
+			if !c.wantLogin {
+				return
+			}
+
+			response, err = s.ChangePassword(ctx, &pb.ChangeRequest{UserId: userId, OldSalted: c.newSalted, NewSalted: c.reused})
+			if err != nil {
+				t.Fatalf("ChangePassword() failed: %v", err)
+			}
+			if response.Success != c.want {
+				t.Errorf("ChangePassword(%s).Success = %v, want %v", c.reused, response.Success, c.want)
+			}
+		})
+	}
+}
+
+// history entries are not rehashed, one with a retired pepper can not block the change
+func TestChangePasswordUnreadableHistory(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, "PASSWORD_HISTORY_SIZE", "2")
+	response, err := s.Register(ctx, &pb.LoginRequest{Login: "user", Salted: "p0"})
+	if err != nil || !response.Success {
+		t.Fatalf("Register() = %v, %v", response, err)
+	}
+
+	userId := response.Id
+	for _, hashed := range []string{"$pepper$retired:$2a$04$abcdefghijklmnopqrstuuG8bm5Kz0Y1vB3AjL5nsT3sIbbgW9FSO", "$2a$xx"} {
+		if err = s.db.Create(&model.PasswordHistory{UserID: userId, Password: hashed}).Error; err != nil {
+			t.Fatalf("Failed to create history entry: %v", err)
+		}
+	}
+
+	response, err = s.ChangePassword(ctx, &pb.ChangeRequest{UserId: userId, OldSalted: "p0", NewSalted: "p1"})
+	if err != nil || !response.Success {
+		t.Errorf("ChangePassword() = %v, %v, want a success", response, err)
+	}
+}
@@ -0,0 +1,209 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+)
+
+const FailuresBeforeSuccess = "failures_before_success"
+
+const (
+	LoginChanged    = "login_changed"
+	PasswordChanged = "password_changed"
+)
+
+const (
+	suspiciousLoginKind   = "suspicious_login"
+	registeredKind        = "registered"
+	credentialChangedKind = "credential_changed"
+)
+
+type SuspiciousLogin struct {
+	UserId    uint64    `json:"userId"`
+	Login     string    `json:"login"`
+	Reason    string    `json:"reason"`
+	At        time.Time `json:"at"`
+	Failures  uint32    `json:"failures"`
+	RequestId string    `json:"requestId,omitempty"`
+}
+
+// UserRegistered carries the roles a new user should receive, for the rights server to assign.
+type UserRegistered struct {
+	UserId       uint64    `json:"userId"`
+	Login        string    `json:"login"`
+	At           time.Time `json:"at"`
+	DefaultRoles []string  `json:"defaultRoles"`
+	RequestId    string    `json:"requestId,omitempty"`
+}
+
+// CredentialChanged tells the other services (like the session server) to revoke what the user obtained before.
+type CredentialChanged struct {
+	UserId    uint64    `json:"userId"`
+	Login     string    `json:"login"`
+	Change    string    `json:"change"`
+	At        time.Time `json:"at"`
+	RequestId string    `json:"requestId,omitempty"`
+}
+
+// Notifier receives the successful logins which looks suspicious, to warn the user,
+// the registrations and the credential changes, to hand them off to the other puzzle services.
+// It is called during the requests, so a slow implementation should work in background.
+type Notifier interface {
+	NotifySuspiciousLogin(ctx context.Context, event SuspiciousLogin)
+	NotifyRegistered(ctx context.Context, event UserRegistered)
+	NotifyCredentialChanged(ctx context.Context, event CredentialChanged)
+}
+
+var errNotifyQueueFull = errors.New("notification queue is full")
+
+const (
+	notifyQueueSize  = 1024
+	notifyMaxTries   = 5
+	notifyRetryDelay = time.Second
+)
+
+// CreateNotifier posts the events to NOTIFY_WEBHOOK_URL when set, otherwise they are only logged.
+func CreateNotifier(logger *otelzap.Logger) Notifier {
+	url := os.Getenv("NOTIFY_WEBHOOK_URL")
+	if url == "" {
+		return LogNotifier(logger)
+	}
+	return newWebhookNotifier(newWebhook(url, notifyWebhookOperation, logger), notifyRetryDelay, logger)
+}
+
+type logNotifier struct {
+	logger *otelzap.Logger
+}
+
+// LogNotifier only logs the events.
+func LogNotifier(logger *otelzap.Logger) Notifier {
+	return logNotifier{logger: logger}
+}
+
+func (n logNotifier) NotifySuspiciousLogin(ctx context.Context, event SuspiciousLogin) {
+	requestLogger(n.logger, ctx).Info("Suspicious login", zap.Uint64("userId", event.UserId),
+		zap.String("reason", event.Reason), zap.Uint32("failures", event.Failures),
+	)
+}
+
+func (n logNotifier) NotifyRegistered(ctx context.Context, event UserRegistered) {
+	requestLogger(n.logger, ctx).Info("User registered", zap.Uint64("userId", event.UserId),
+		zap.Strings("defaultRoles", event.DefaultRoles),
+	)
+}
+
+func (n logNotifier) NotifyCredentialChanged(ctx context.Context, event CredentialChanged) {
+	requestLogger(n.logger, ctx).Info("Credential changed", zap.Uint64("userId", event.UserId), zap.String("change", event.Change))
+}
+
+type notification struct {
+	Kind  string `json:"kind"`
+	Event any    `json:"event"`
+	// not sent, to report a lost notification
+	userId uint64
+}
+
+// webhookNotifier logs the events too, they are posted in order by a background worker.
+// The delivery is at least once while the webhook answers within notifyMaxTries tries (the delay doubles
+// from retryDelay, about 15s in total). An event is lost when the webhook stays unavailable longer,
+// when notifyQueueSize events are already waiting, or when the process stops : it is then logged as an error
+// with its user, so a missed revocation can be handled by hand.
+type webhookNotifier struct {
+	logNotifier
+	hook       webhook
+	retryDelay time.Duration
+	queue      chan notification
+}
+
+func newWebhookNotifier(hook webhook, retryDelay time.Duration, logger *otelzap.Logger) webhookNotifier {
+	n := webhookNotifier{
+		logNotifier: logNotifier{logger: logger}, hook: hook, retryDelay: retryDelay,
+		queue: make(chan notification, notifyQueueSize),
+	}
+	go n.deliver()
+	return n
+}
+
+func (n webhookNotifier) NotifySuspiciousLogin(ctx context.Context, event SuspiciousLogin) {
+	n.logNotifier.NotifySuspiciousLogin(ctx, event)
+	n.enqueue(notification{Kind: suspiciousLoginKind, Event: event, userId: event.UserId})
+}
+
+func (n webhookNotifier) NotifyRegistered(ctx context.Context, event UserRegistered) {
+	n.logNotifier.NotifyRegistered(ctx, event)
+	n.enqueue(notification{Kind: registeredKind, Event: event, userId: event.UserId})
+}
+
+func (n webhookNotifier) NotifyCredentialChanged(ctx context.Context, event CredentialChanged) {
+	n.logNotifier.NotifyCredentialChanged(ctx, event)
+	n.enqueue(notification{Kind: credentialChangedKind, Event: event, userId: event.UserId})
+}
+
+// never blocks the request
+func (n webhookNotifier) enqueue(event notification) {
+	select {
+	case n.queue <- event:
+	default:
+		n.lost(event, errNotifyQueueFull)
+	}
+}
+
+func (n webhookNotifier) deliver() {
+	for event := range n.queue {
+		delay := n.retryDelay
+		var err error
+		for try := 1; ; try++ {
+			if err = n.hook.send(event); err == nil || try == notifyMaxTries {
+				break
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err != nil {
+			n.lost(event, err)
+		}
+	}
+}
+
+func (n webhookNotifier) lost(event notification, err error) {
+	n.logger.Error("Notification lost", zap.String("kind", event.Kind), zap.Uint64("userId", event.userId), zap.Error(err))
+	degraded(notifyWebhookOperation)
+}
+
+// DEFAULT_ROLES is a comma separated list, passed as is
+func readDefaultRoles() []string {
+	rolesStr := os.Getenv("DEFAULT_ROLES")
+	if rolesStr == "" {
+		return nil
+	}
+
+	roles := strings.Split(rolesStr, ",")
+	for index, role := range roles {
+		roles[index] = strings.TrimSpace(role)
+	}
+	return roles
+}
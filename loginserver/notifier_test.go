@@ -0,0 +1,137 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("Failed to decode payload: %v", err)
+		}
+		received <- payload
+	}))
+	defer server.Close()
+
+	t.Setenv("NOTIFY_WEBHOOK_URL", server.URL)
+	notifier := CreateNotifier(testLogger())
+	ctx := context.Background()
+	cases := []struct {
+		name     string
+		notify   func()
+		wantKind string
+	}{
+		{"suspicious login", func() {
+			notifier.NotifySuspiciousLogin(ctx, SuspiciousLogin{UserId: 1, Reason: FailuresBeforeSuccess, Failures: 3})
+		}, suspiciousLoginKind},
+		{"registered", func() {
+			notifier.NotifyRegistered(ctx, UserRegistered{UserId: 1, DefaultRoles: []string{"reader"}})
+		}, registeredKind},
+		{"credential changed", func() {
+			notifier.NotifyCredentialChanged(ctx, CredentialChanged{UserId: 1, Change: PasswordChanged})
+		}, credentialChangedKind},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.notify()
+			select {
+			case payload := <-received:
+				if payload["kind"] != c.wantKind {
+					t.Errorf("kind = %v, want %s", payload["kind"], c.wantKind)
+				}
+				if event, _ := payload["event"].(map[string]any); event["userId"] != float64(1) {
+					t.Errorf("event = %v, want the user id", payload["event"])
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no notification received")
+			}
+		})
+	}
+}
+
+func TestCreateNotifierWithoutWebhook(t *testing.T) {
+	t.Setenv("NOTIFY_WEBHOOK_URL", "")
+	if _, ok := CreateNotifier(testLogger()).(logNotifier); !ok {
+		t.Errorf("CreateNotifier() should only log without NOTIFY_WEBHOOK_URL")
+	}
+}
+
+func degradedCount(operation string) int64 {
+	if count, ok := degradedOperations.Get(operation).(*expvar.Int); ok {
+		return count.Value()
+	}
+	return 0
+}
+
+func TestWebhookNotifierRetries(t *testing.T) {
+	cases := []struct {
+		name string
+		// answers refused before the webhook accepts
+		refusals  int32
+		wantCalls int32
+		wantLost  int64
+	}{
+		{"first try", 0, 1, 0},
+		{"after retries", 2, 3, 0},
+		{"lost", notifyMaxTries, notifyMaxTries, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) <= c.refusals {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}))
+			defer server.Close()
+
+			lost := degradedCount(notifyWebhookOperation)
+			logger := testLogger()
+			notifier := newWebhookNotifier(newWebhook(server.URL, notifyWebhookOperation, logger), time.Millisecond, logger)
+			notifier.NotifyCredentialChanged(context.Background(), CredentialChanged{UserId: 1, Change: PasswordChanged})
+
+			deadline := time.Now().Add(5 * time.Second)
+			for calls.Load() < c.wantCalls || degradedCount(notifyWebhookOperation)-lost < c.wantLost {
+				if time.Now().After(deadline) {
+					t.Fatalf("got %d calls, want %d", calls.Load(), c.wantCalls)
+				}
+				time.Sleep(time.Millisecond)
+			}
+			// no further try once delivered or given up
+			time.Sleep(50 * time.Millisecond)
+			if got := calls.Load(); got != c.wantCalls {
+				t.Errorf("got %d calls, want %d", got, c.wantCalls)
+			}
+			if got := degradedCount(notifyWebhookOperation) - lost; got != c.wantLost {
+				t.Errorf("got %d lost notifications, want %d", got, c.wantLost)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const requestIdKey = "x-request-id"
+
+const maxRequestIdLen = 128
+
+type requestIdCtxKey struct{}
+
+// RequestIdInterceptor reuses the request id sent by the caller (or generates one),
+// sends it back in the response header and attaches it to the span and to the logs.
+func RequestIdInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	requestId := incomingRequestId(ctx)
+	if requestId == "" {
+		requestId = generateRequestId()
+	}
+
+	grpc.SetHeader(ctx, metadata.Pairs(requestIdKey, requestId))
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("request.id", requestId))
+	return handler(context.WithValue(ctx, requestIdCtxKey{}, requestId), req)
+}
+
+func incomingRequestId(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(requestIdKey)
+	if len(values) == 0 {
+		return ""
+	}
+
+	// ignore ids we would not want to copy in every log line
+	requestId := values[0]
+	if len(requestId) > maxRequestIdLen {
+		return ""
+	}
+	for _, char := range requestId {
+		if char < '!' || char > '~' {
+			return ""
+		}
+	}
+	return requestId
+}
+
+func generateRequestId() string {
+	var idBytes [16]byte
+	rand.Read(idBytes[:])
+	return hex.EncodeToString(idBytes[:])
+}
+
+// RequestId returns the id attached by RequestIdInterceptor (empty outside of a request).
+func RequestId(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdCtxKey{}).(string)
+	return requestId
+}
+
+func (s server) ctxLogger(ctx context.Context) otelzap.LoggerWithCtx {
+	return requestLogger(s.logger, ctx)
+}
+
+func requestLogger(logger *otelzap.Logger, ctx context.Context) otelzap.LoggerWithCtx {
+	ctxLogger := logger.Ctx(ctx)
+	if requestId := RequestId(ctx); requestId != "" {
+		ctxLogger = ctxLogger.WithOptions(zap.Fields(zap.String("requestId", requestId)))
+	}
+	return ctxLogger
+}
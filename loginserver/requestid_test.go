@@ -0,0 +1,105 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	pb "github.com/dvaumoron/puzzleloginservice"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+type registeredRecorder struct {
+	Notifier
+	events []UserRegistered
+}
+
+func (r *registeredRecorder) NotifyRegistered(ctx context.Context, event UserRegistered) {
+	r.events = append(r.events, event)
+}
+
+func TestRequestIdInterceptor(t *testing.T) {
+	cases := []struct {
+		name     string
+		incoming []string
+		// empty when a new id should be generated
+		want string
+	}{
+		{"missing", nil, ""},
+		{"reused", []string{"caller-id-1"}, "caller-id-1"},
+		{"first value", []string{"caller-id-1", "caller-id-2"}, "caller-id-1"},
+		{"too long", []string{strings.Repeat("a", maxRequestIdLen+1)}, ""},
+		{"longest", []string{strings.Repeat("a", maxRequestIdLen)}, strings.Repeat("a", maxRequestIdLen)},
+		{"space", []string{"caller id"}, ""},
+		{"not ascii", []string{"caller-é"}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			if len(c.incoming) != 0 {
+				md := metadata.MD{}
+				md.Append(requestIdKey, c.incoming...)
+				ctx = metadata.NewIncomingContext(ctx, md)
+			}
+
+			var got string
+			RequestIdInterceptor(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req any) (any, error) {
+				got = RequestId(ctx)
+				return nil, nil
+			})
+			switch {
+			case c.want != "" && got != c.want:
+				t.Errorf("RequestId() = %q, want %q", got, c.want)
+			case c.want == "" && len(got) != 32:
+				t.Errorf("RequestId() = %q, want a generated id", got)
+			}
+		})
+	}
+}
+
+func TestRequestIdPropagation(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger := otelzap.New(zap.New(core))
+	recorder := &registeredRecorder{Notifier: LogNotifier(logger)}
+	s := newTestServer(t)
+	s.notifier = recorder
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestIdKey, "caller-id"))
+
+	RequestIdInterceptor(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req any) (any, error) {
+		LogNotifier(logger).NotifySuspiciousLogin(ctx, SuspiciousLogin{UserId: 1})
+		newAlerter(logger).raise(ctx, securityAlert{Kind: "test"})
+		return s.Register(ctx, &pb.LoginRequest{Login: "user", Salted: "p0"})
+	})
+
+	if len(recorder.events) != 1 || recorder.events[0].RequestId != "caller-id" {
+		t.Errorf("registered events = %+v, want one with RequestId %q", recorder.events, "caller-id")
+	}
+	for _, message := range []string{"Suspicious login", alertMsg} {
+		entries := logs.FilterMessage(message).FilterField(zap.String("requestId", "caller-id")).Len()
+		if entries != 1 {
+			t.Errorf("%q logged %d times with the request id, want 1", message, entries)
+		}
+	}
+}
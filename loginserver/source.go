@@ -0,0 +1,146 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// sourceResolver finds the address of the end user, in the metadata set by the puzzle gateway
+// when SOURCE_ADDRESS_KEY is configured (the gRPC peer otherwise). The metadata can be set by any caller,
+// so it is only read when the peer is in SOURCE_TRUSTED_PROXIES.
+type sourceResolver struct {
+	metadataKey    string
+	trustedProxies []*net.IPNet
+	allowlist      []*net.IPNet
+}
+
+func newSourceResolver(logger *otelzap.Logger) sourceResolver {
+	r := sourceResolver{
+		metadataKey:    strings.ToLower(os.Getenv("SOURCE_ADDRESS_KEY")),
+		trustedProxies: readNetworks(logger, "SOURCE_TRUSTED_PROXIES"),
+		allowlist:      readNetworks(logger, "SOURCE_ALLOWLIST"),
+	}
+	if r.metadataKey != "" && len(r.trustedProxies) == 0 {
+		logger.Fatal("SOURCE_ADDRESS_KEY requires SOURCE_TRUSTED_PROXIES")
+	}
+	return r
+}
+
+// addresses or CIDR, separated by commas
+func readNetworks(logger *otelzap.Logger, name string) []*net.IPNet {
+	networksStr := os.Getenv(name)
+	if networksStr == "" {
+		return nil
+	}
+
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(networksStr, ",") {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			logger.Fatal("Failed to parse networks", zap.String("name", name), zap.String("entry", entry), zap.Error(err))
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func contains(networks []*net.IPNet, address string) bool {
+	if ip := net.ParseIP(address); ip != nil {
+		for _, network := range networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// return an empty string for trusted sources, which are neither throttled nor tracked
+func (r sourceResolver) source(ctx context.Context) string {
+	source := peerAddress(ctx)
+	if contains(r.trustedProxies, source) {
+		if forwarded := r.forwarded(ctx); forwarded != "" {
+			source = forwarded
+		}
+	}
+
+	if contains(r.allowlist, source) {
+		return ""
+	}
+	return source
+}
+
+// each proxy appends the address it received the request from, so the entries on the left are set by the
+// end user : the rightmost entry which is not a trusted proxy is kept, an entry which is not an address
+// makes the whole value unreliable. Addresses are normalized, a client can not get new keys by rewriting its own.
+func (r sourceResolver) forwarded(ctx context.Context) string {
+	if r.metadataKey == "" {
+		return ""
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	var entries []string
+	for _, value := range md.Get(r.metadataKey) {
+		entries = append(entries, strings.Split(value, ",")...)
+	}
+
+	for index := len(entries) - 1; index >= 0; index-- {
+		ip := net.ParseIP(strings.TrimSpace(entries[index]))
+		if ip == nil {
+			return ""
+		}
+
+		address := ip.String()
+		if !contains(r.trustedProxies, address) {
+			return address
+		}
+	}
+	return ""
+}
+
+func peerAddress(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
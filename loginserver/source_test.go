@@ -0,0 +1,100 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func mustNetworks(t *testing.T, cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func TestSource(t *testing.T) {
+	resolver := sourceResolver{
+		metadataKey:    "x-forwarded-for",
+		trustedProxies: mustNetworks(t, "10.0.0.0/8"),
+		allowlist:      mustNetworks(t, "192.168.1.0/24"),
+	}
+	cases := []struct {
+		name      string
+		peer      string
+		forwarded []string
+		want      string
+	}{
+		{"no peer", "", nil, ""},
+		{"peer only", "203.0.113.5:4000", nil, "203.0.113.5"},
+		{"untrusted peer", "203.0.113.5:4000", []string{"198.51.100.7"}, "203.0.113.5"},
+		{"untrusted peer allowlisted value", "203.0.113.5:4000", []string{"192.168.1.2"}, "203.0.113.5"},
+		{"trusted proxy without value", "10.0.0.1:4000", nil, "10.0.0.1"},
+		{"trusted proxy", "10.0.0.1:4000", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"spoofed leftmost entry", "10.0.0.1:4000", []string{"1.2.3.4, 198.51.100.7"}, "198.51.100.7"},
+		{"proxy chain", "10.0.0.1:4000", []string{"1.2.3.4, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"several values", "10.0.0.1:4000", []string{"1.2.3.4", "198.51.100.7"}, "198.51.100.7"},
+		{"not an address", "10.0.0.1:4000", []string{"1.2.3.4, random-value"}, "10.0.0.1"},
+		{"normalized", "10.0.0.1:4000", []string{"::ffff:198.51.100.7"}, "198.51.100.7"},
+		{"only proxies", "10.0.0.1:4000", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.1"},
+		{"allowlisted", "10.0.0.1:4000", []string{"192.168.1.2"}, ""},
+		{"allowlisted peer", "192.168.1.3:4000", nil, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			if c.peer != "" {
+				addr, err := net.ResolveTCPAddr("tcp", c.peer)
+				if err != nil {
+					t.Fatalf("Failed to parse %s: %v", c.peer, err)
+				}
+				ctx = peer.NewContext(ctx, &peer.Peer{Addr: addr})
+			}
+			if len(c.forwarded) != 0 {
+				md := metadata.MD{}
+				md.Append(resolver.metadataKey, c.forwarded...)
+				ctx = metadata.NewIncomingContext(ctx, md)
+			}
+
+			if got := resolver.source(ctx); got != c.want {
+				t.Errorf("source() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSourceWithoutMetadataKey(t *testing.T) {
+	resolver := sourceResolver{trustedProxies: mustNetworks(t, "10.0.0.0/8")}
+	addr, _ := net.ResolveTCPAddr("tcp", "10.0.0.1:4000")
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("x-forwarded-for", "198.51.100.7"))
+	if got := resolver.source(ctx); got != "10.0.0.1" {
+		t.Errorf("source() = %q, want the peer address", got)
+	}
+}
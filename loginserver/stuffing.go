@@ -0,0 +1,132 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/dvaumoron/puzzleloginserver/internal/envconfig"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+)
+
+const credentialStuffingAlert = "credential_stuffing"
+
+type sourceActivity struct {
+	windowStart  time.Time
+	logins       map[string]struct{}
+	alerted      bool
+	blockedUntil time.Time
+}
+
+// stuffingDetector raises an alert when a source fails to verify too many distinct logins
+// during a window, and can then refuse that source for a while. A nil stuffingDetector is disabled.
+type stuffingDetector struct {
+	mutex         sync.Mutex
+	clock         Clock
+	alerter       alerter
+	window        time.Duration
+	threshold     int
+	blockDuration time.Duration
+	sources       map[string]*sourceActivity
+	lastSweep     time.Time
+}
+
+func newStuffingDetector(clock Clock, alerter alerter, logger *otelzap.Logger) *stuffingDetector {
+	threshold := int(envconfig.ReadUint(logger, "STUFFING_DISTINCT_LOGINS", 0, 32))
+	if threshold == 0 {
+		return nil
+	}
+
+	return &stuffingDetector{
+		clock:         clock,
+		alerter:       alerter,
+		window:        envconfig.ReadDuration(logger, "STUFFING_WINDOW", 10*time.Minute),
+		threshold:     threshold,
+		blockDuration: envconfig.ReadDuration(logger, "STUFFING_BLOCK_DURATION", 0),
+		sources:       map[string]*sourceActivity{},
+		lastSweep:     clock.Now(),
+	}
+}
+
+func (d *stuffingDetector) blocked(source string) bool {
+	if d == nil || source == "" {
+		return false
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	activity, ok := d.sources[source]
+	return ok && d.clock.Now().Before(activity.blockedUntil)
+}
+
+func (d *stuffingDetector) recordFailure(ctx context.Context, source string, login string) {
+	if d == nil || source == "" {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := d.clock.Now()
+	d.sweep(now)
+
+	activity, ok := d.sources[source]
+	if !ok {
+		activity = &sourceActivity{windowStart: now, logins: map[string]struct{}{}}
+		d.sources[source] = activity
+	} else if now.Sub(activity.windowStart) >= d.window {
+		activity.windowStart = now
+		activity.logins = map[string]struct{}{}
+		activity.alerted = false
+	}
+
+	// the count stops at the threshold, which is all the alert needs (memory stays bounded under a flood)
+	if len(activity.logins) < d.threshold {
+		activity.logins[login] = struct{}{}
+	}
+	if activity.alerted || len(activity.logins) < d.threshold {
+		return
+	}
+
+	activity.alerted = true
+	blocked := d.blockDuration != 0
+	if blocked {
+		activity.blockedUntil = now.Add(d.blockDuration)
+	}
+	d.alerter.raise(ctx, securityAlert{Kind: credentialStuffingAlert, At: now, Details: map[string]any{
+		"source": source, "windowStart": activity.windowStart, "distinctLogins": len(activity.logins), "blocked": blocked,
+	}})
+}
+
+// forget the sources without recent activity nor running block, to keep memory bounded
+func (d *stuffingDetector) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < d.window {
+		return
+	}
+
+	d.lastSweep = now
+	for source, activity := range d.sources {
+		if now.Sub(activity.windowStart) >= d.window && !now.Before(activity.blockedUntil) {
+			delete(d.sources, source)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dvaumoron/puzzleloginserver/model"
+	pb "github.com/dvaumoron/puzzleloginservice"
+	"google.golang.org/grpc/peer"
+)
+
+func TestStuffingDetector(t *testing.T) {
+	cases := []struct {
+		name string
+		// failed logins of the source, an empty login advances the clock by a minute
+		logins      []string
+		wantBlocked bool
+	}{
+		{"below threshold", []string{"a", "b"}, false},
+		{"same login", []string{"a", "a", "a", "a"}, false},
+		{"threshold", []string{"a", "b", "c"}, true},
+		{"new window", []string{"a", "b", "", "", "", "", "", "", "", "", "", "", "c"}, false},
+		{"block expired", []string{"a", "b", "c", "", "", "", "", "", ""}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			clock := newTestClock()
+			detector := &stuffingDetector{
+				clock: clock, alerter: newAlerter(testLogger()), window: 10 * time.Minute, threshold: 3,
+				blockDuration: 5 * time.Minute, sources: map[string]*sourceActivity{}, lastSweep: clock.Now(),
+			}
+			for _, login := range c.logins {
+				if login == "" {
+					clock.advance(time.Minute)
+					continue
+				}
+				detector.recordFailure(context.Background(), "198.51.100.7", login)
+			}
+
+			if got := detector.blocked("198.51.100.7"); got != c.wantBlocked {
+				t.Errorf("blocked() = %v, want %v", got, c.wantBlocked)
+			}
+			if detector.blocked("203.0.113.5") {
+				t.Errorf("blocked() an unrelated source")
+			}
+		})
+	}
+}
+
+func TestStuffingDetectorBounded(t *testing.T) {
+	clock := newTestClock()
+	detector := &stuffingDetector{
+		clock: clock, alerter: newAlerter(testLogger()), window: 10 * time.Minute, threshold: 3,
+		sources: map[string]*sourceActivity{}, lastSweep: clock.Now(),
+	}
+	for _, login := range []string{"a", "b", "c", "d", "e", "f"} {
+		detector.recordFailure(context.Background(), "198.51.100.7", login)
+	}
+	if got := len(detector.sources["198.51.100.7"].logins); got != 3 {
+		t.Errorf("kept %d logins, want 3", got)
+	}
+}
+
+func TestStuffingDetectorDisabled(t *testing.T) {
+	var detector *stuffingDetector
+	detector.recordFailure(context.Background(), "198.51.100.7", "a")
+	if detector.blocked("198.51.100.7") {
+		t.Errorf("blocked() with a nil detector")
+	}
+}
+
+// the attempts of a blocked source are not counted against the logins it targets
+func TestVerifyBlockedSource(t *testing.T) {
+	s := newTestServer(t, "STUFFING_DISTINCT_LOGINS", "2", "STUFFING_BLOCK_DURATION", "1h")
+	addr, _ := net.ResolveTCPAddr("tcp", "198.51.100.7:4000")
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+	for _, login := range []string{"a", "b", "victim", "victim"} {
+		response, err := s.Verify(ctx, &pb.LoginRequest{Login: login, Salted: "wrong"})
+		if err != nil || response.Success {
+			t.Fatalf("Verify(%s) = %v, %v", login, response, err)
+		}
+	}
+
+	var count int64
+	if err := s.db.Model(&model.Throttle{}).Where("subject = ?", loginThrottlePrefix+"victim").Count(&count).Error; err != nil {
+		t.Fatalf("Failed to count throttles: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("the refused attempts were counted against the victim")
+	}
+	// but they are failures for the monitor
+	if s.monitor.failures != 4 {
+		t.Errorf("monitor counted %d failures, want 4", s.monitor.failures)
+	}
+}
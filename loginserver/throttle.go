@@ -0,0 +1,222 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/dvaumoron/puzzleloginserver/internal/envconfig"
+	"github.com/dvaumoron/puzzleloginserver/model"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// bounds the optimistic updates of a key, a flood on it can not keep a request looping
+const maxReserveTries = 8
+
+const (
+	loginThrottlePrefix    = "login:"
+	callerThrottlePrefix   = "caller:"
+	registerThrottlePrefix = "register:"
+)
+
+// throttler blocks a login or a caller for an exponentially growing delay once it reached
+// its threshold of consecutive failed attempts, counters are stored in database to survive restarts.
+// Registrations are counted the same way per caller (each attempt is a "failure").
+// A zero threshold disables the matching kind of key.
+type throttler struct {
+	db                *gorm.DB
+	clock             Clock
+	sources           sourceResolver
+	loginThreshold    uint32
+	callerThreshold   uint32
+	registerThreshold uint32
+	baseDelay         time.Duration
+	maxDelay          time.Duration
+	resetAfter        time.Duration
+}
+
+func newThrottler(db *gorm.DB, clock Clock, sources sourceResolver, logger *otelzap.Logger) throttler {
+	t := throttler{
+		db:                db,
+		clock:             clock,
+		sources:           sources,
+		loginThreshold:    uint32(envconfig.ReadUintOrZero(logger, "THROTTLE_LOGIN_THRESHOLD", 5, 32)),
+		callerThreshold:   uint32(envconfig.ReadUint(logger, "THROTTLE_CALLER_THRESHOLD", 0, 32)),
+		registerThreshold: uint32(envconfig.ReadUint(logger, "THROTTLE_REGISTER_THRESHOLD", 0, 32)),
+		baseDelay:         envconfig.ReadDuration(logger, "THROTTLE_BASE_DELAY", time.Second),
+		maxDelay:          envconfig.ReadDuration(logger, "THROTTLE_MAX_DELAY", 15*time.Minute),
+		resetAfter:        envconfig.ReadDuration(logger, "THROTTLE_RESET_AFTER", time.Hour),
+	}
+	go t.purge(logger)
+	return t
+}
+
+// without SOURCE_ADDRESS_KEY the caller is the frontend, its threshold should then be high
+func (t throttler) keys(ctx context.Context, login string) []string {
+	keys := make([]string, 0, 2)
+	if t.callerThreshold != 0 {
+		if caller := t.sources.source(ctx); caller != "" {
+			keys = append(keys, callerThrottlePrefix+caller)
+		}
+	}
+	if t.loginThreshold != 0 {
+		keys = append(keys, loginThrottlePrefix+login)
+	}
+	return keys
+}
+
+func (t throttler) registerKeys(ctx context.Context) []string {
+	if t.registerThreshold != 0 {
+		if caller := t.sources.source(ctx); caller != "" {
+			return []string{registerThrottlePrefix + caller}
+		}
+	}
+	return nil
+}
+
+// attempt counts a new attempt on each key before the credentials are checked, so concurrent attempts
+// can not all get through, and reports whether a key is blocked (the attempt is then not counted on it).
+// Keys are handled in order, callers come first so an attempt refused for its caller does not count against the login.
+func (t throttler) attempt(ctx context.Context, keys []string) (bool, error) {
+	if len(keys) == 0 {
+		return false, nil
+	}
+
+	db := t.db.WithContext(ctx)
+	for _, key := range keys {
+		blocked, err := t.reserve(db, key)
+		if err != nil || blocked {
+			return blocked, err
+		}
+	}
+	return false, nil
+}
+
+// optimistic update, the row is only written when its count did not change since it was read
+func (t throttler) reserve(db *gorm.DB, key string) (bool, error) {
+	for try := 0; try < maxReserveTries; try++ {
+		now := t.clock.Now()
+		var throttle model.Throttle
+		err := db.First(&throttle, "subject = ?", key).Error
+		found := err == nil
+		if !found && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, err
+		}
+		if found && throttle.BlockedUntil.After(now) {
+			return true, nil
+		}
+
+		failures := uint32(1)
+		// old failures are forgotten
+		if found && now.Sub(throttle.UpdatedAt) <= t.resetAfter {
+			failures = throttle.Failures + 1
+		}
+		blockedUntil := now.Add(t.delay(key, failures))
+
+		var result *gorm.DB
+		if found {
+			result = db.Model(&model.Throttle{}).Where("subject = ? AND failures = ?", key, throttle.Failures).Updates(map[string]any{
+				"updated_at": now, "failures": failures, "blocked_until": blockedUntil,
+			})
+		} else {
+			result = db.Clauses(clause.OnConflict{DoNothing: true}).Create(&model.Throttle{
+				Subject: key, UpdatedAt: now, Failures: failures, BlockedUntil: blockedUntil,
+			})
+		}
+		if result.Error != nil {
+			return false, result.Error
+		}
+		if result.RowsAffected != 0 {
+			return false, nil
+		}
+	}
+	// every try lost against a concurrent attempt, the key is flooded
+	return true, nil
+}
+
+// a success clears the login (returning the failures before it) and gives its attempt back to the caller,
+// a caller mixing valid and invalid attempts is still counted
+func (t throttler) succeed(ctx context.Context, keys []string) (uint32, error) {
+	db := t.db.WithContext(ctx)
+	var failures uint32
+	for _, key := range keys {
+		if !strings.HasPrefix(key, loginThrottlePrefix) {
+			err := db.Model(&model.Throttle{}).Where("subject = ? AND failures > 0", key).Update("failures", gorm.Expr("failures - 1")).Error
+			if err != nil {
+				return failures, err
+			}
+			continue
+		}
+
+		var throttle model.Throttle
+		err := db.First(&throttle, "subject = ?", key).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				continue
+			}
+			return failures, err
+		}
+		// the successful attempt was counted too, old failures are forgotten like in reserve
+		if throttle.Failures != 0 && t.clock.Now().Sub(throttle.UpdatedAt) <= t.resetAfter {
+			failures = throttle.Failures - 1
+		}
+		if err = db.Delete(&throttle).Error; err != nil {
+			return failures, err
+		}
+	}
+	return failures, nil
+}
+
+func (t throttler) delay(key string, failures uint32) time.Duration {
+	threshold := t.loginThreshold
+	switch {
+	case strings.HasPrefix(key, callerThrottlePrefix):
+		threshold = t.callerThreshold
+	case strings.HasPrefix(key, registerThrottlePrefix):
+		threshold = t.registerThreshold
+	}
+	if failures < threshold {
+		return 0
+	}
+
+	delay := t.baseDelay
+	for i := threshold; i < failures && delay < t.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.maxDelay {
+		delay = t.maxDelay
+	}
+	return delay
+}
+
+func (t throttler) purge(logger *otelzap.Logger) {
+	for range time.Tick(t.resetAfter) {
+		err := t.db.Delete(&model.Throttle{}, "updated_at < ? AND blocked_until < ?",
+			t.clock.Now().Add(-t.resetAfter), t.clock.Now()).Error
+		if err != nil {
+			logger.Warn("Failed to purge throttles", zap.Error(err))
+		}
+	}
+}
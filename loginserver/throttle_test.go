@@ -0,0 +1,189 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dvaumoron/puzzleloginserver/model"
+)
+
+func newTestThrottler(t *testing.T, clock Clock) throttler {
+	return throttler{
+		db: testDB(t, &model.Throttle{}), clock: clock, loginThreshold: 3, callerThreshold: 2, registerThreshold: 2,
+		baseDelay: time.Second, maxDelay: 10 * time.Second, resetAfter: time.Hour,
+	}
+}
+
+func TestThrottleDelay(t *testing.T) {
+	limiter := throttler{loginThreshold: 3, callerThreshold: 5, registerThreshold: 2, baseDelay: time.Second, maxDelay: 10 * time.Second}
+	cases := []struct {
+		key      string
+		failures uint32
+		want     time.Duration
+	}{
+		{"login:user", 0, 0},
+		{"login:user", 2, 0},
+		{"login:user", 3, time.Second},
+		{"login:user", 4, 2 * time.Second},
+		{"login:user", 6, 8 * time.Second},
+		{"login:user", 7, 10 * time.Second},
+		{"login:user", 1000, 10 * time.Second},
+		{"caller:10.0.0.1", 4, 0},
+		{"caller:10.0.0.1", 5, time.Second},
+		{"register:10.0.0.1", 1, 0},
+		{"register:10.0.0.1", 3, 2 * time.Second},
+	}
+	for _, c := range cases {
+		if got := limiter.delay(c.key, c.failures); got != c.want {
+			t.Errorf("delay(%s, %d) = %v, want %v", c.key, c.failures, got, c.want)
+		}
+	}
+}
+
+func TestThrottleAttempt(t *testing.T) {
+	type step struct {
+		// clock advance before the attempt
+		wait        time.Duration
+		keys        []string
+		wantBlocked bool
+	}
+	login := []string{"login:user"}
+	both := []string{"caller:10.0.0.1", "login:user"}
+	cases := []struct {
+		name          string
+		steps         []step
+		wantFailures  map[string]uint32
+		wantSucceeded uint32
+	}{
+		{"below threshold", []step{{0, login, false}, {0, login, false}}, map[string]uint32{"login:user": 2}, 1},
+		{"blocked at threshold", []step{{0, login, false}, {0, login, false}, {0, login, false}, {0, login, true}}, map[string]uint32{"login:user": 3}, 2},
+		{"delay elapsed", []step{
+			{0, login, false}, {0, login, false}, {0, login, false}, {time.Second, login, false}, {time.Second, login, true},
+		}, map[string]uint32{"login:user": 4}, 3},
+		{"stale failures forgotten", []step{
+			{0, login, false}, {0, login, false}, {0, login, false}, {2 * time.Hour, login, false},
+		}, map[string]uint32{"login:user": 1}, 0},
+		{"caller counted first", []step{
+			{0, both, false}, {0, both, false}, {0, both, true},
+		}, map[string]uint32{"caller:10.0.0.1": 2, "login:user": 2}, 1},
+		{"no keys", []step{{0, nil, false}}, map[string]uint32{}, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			clock := newTestClock()
+			limiter := newTestThrottler(t, clock)
+			for i, s := range c.steps {
+				clock.advance(s.wait)
+				blocked, err := limiter.attempt(ctx, s.keys)
+				if err != nil {
+					t.Fatalf("attempt() failed: %v", err)
+				}
+				if blocked != s.wantBlocked {
+					t.Fatalf("attempt() at step %d = %v, want %v", i, blocked, s.wantBlocked)
+				}
+			}
+
+			var throttles []model.Throttle
+			if err := limiter.db.Find(&throttles).Error; err != nil {
+				t.Fatalf("Failed to read throttles: %v", err)
+			}
+			if len(throttles) != len(c.wantFailures) {
+				t.Errorf("got %d throttles, want %d", len(throttles), len(c.wantFailures))
+			}
+			for _, throttle := range throttles {
+				if want := c.wantFailures[throttle.Subject]; throttle.Failures != want {
+					t.Errorf("failures of %s = %d, want %d", throttle.Subject, throttle.Failures, want)
+				}
+			}
+
+			keys := c.steps[len(c.steps)-1].keys
+			failures, err := limiter.succeed(ctx, keys)
+			if err != nil {
+				t.Fatalf("succeed() failed: %v", err)
+			}
+			if failures != c.wantSucceeded {
+				t.Errorf("succeed() = %d, want %d", failures, c.wantSucceeded)
+			}
+			var remaining int64
+			if err = limiter.db.Model(&model.Throttle{}).Where("subject = ?", "login:user").Count(&remaining).Error; err != nil {
+				t.Fatalf("Failed to count throttles: %v", err)
+			}
+			if remaining != 0 {
+				t.Errorf("the login throttle is kept after a success")
+			}
+		})
+	}
+}
+
+func TestThrottleSucceedCaller(t *testing.T) {
+	ctx := context.Background()
+	limiter := newTestThrottler(t, newTestClock())
+	keys := []string{"caller:10.0.0.1"}
+	for i := 0; i < 2; i++ {
+		if _, err := limiter.attempt(ctx, keys); err != nil {
+			t.Fatalf("attempt() failed: %v", err)
+		}
+	}
+	if _, err := limiter.succeed(ctx, keys); err != nil {
+		t.Fatalf("succeed() failed: %v", err)
+	}
+
+	var throttle model.Throttle
+	if err := limiter.db.First(&throttle, "subject = ?", keys[0]).Error; err != nil {
+		t.Fatalf("Failed to read throttle: %v", err)
+	}
+	if throttle.Failures != 1 {
+		t.Errorf("caller failures = %d, want 1", throttle.Failures)
+	}
+}
+
+func TestThrottleSucceedStale(t *testing.T) {
+	ctx := context.Background()
+	clock := newTestClock()
+	limiter := newTestThrottler(t, clock)
+	cases := []struct {
+		name      string
+		updatedAt time.Time
+		want      uint32
+	}{
+		{"recent", clock.Now().Add(-time.Minute), 4},
+		{"stale", clock.Now().Add(-2 * time.Hour), 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			keys := []string{"login:" + c.name}
+			err := limiter.db.Create(&model.Throttle{Subject: keys[0], UpdatedAt: c.updatedAt, Failures: 5}).Error
+			if err != nil {
+				t.Fatalf("Failed to create throttle: %v", err)
+			}
+
+			failures, err := limiter.succeed(ctx, keys)
+			if err != nil {
+				t.Fatalf("succeed() failed: %v", err)
+			}
+			if failures != c.want {
+				t.Errorf("succeed() = %d, want %d", failures, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dvaumoron/puzzleloginserver/internal/envconfig"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errTimeout = status.Error(codes.DeadlineExceeded, "request took too long")
+
+// MethodTimeouts bounds the handling of each method : RPC_TIMEOUT applies to all of them
+// and RPC_METHOD_TIMEOUTS ("Verify=2s,ListUsers=10s") overrides it by method name.
+// The interceptor is needed to create the server, which loads the configuration,
+// hence the separate Read call (before serving).
+type MethodTimeouts struct {
+	all      time.Duration
+	byMethod map[string]time.Duration
+}
+
+func (m *MethodTimeouts) Read(logger *otelzap.Logger) {
+	m.all = envconfig.ReadDuration(logger, "RPC_TIMEOUT", 0)
+	m.byMethod = map[string]time.Duration{}
+	timeoutsStr := os.Getenv("RPC_METHOD_TIMEOUTS")
+	if timeoutsStr == "" {
+		return
+	}
+
+	for _, timeoutStr := range strings.Split(timeoutsStr, ",") {
+		method, durationStr, ok := strings.Cut(strings.TrimSpace(timeoutStr), "=")
+		duration, err := time.ParseDuration(durationStr)
+		if !ok || method == "" || err != nil || duration <= 0 {
+			logger.Fatal("Failed to parse RPC_METHOD_TIMEOUTS, expected method=duration", zap.String("value", timeoutStr))
+		}
+		m.byMethod[method] = duration
+	}
+}
+
+// a shorter deadline set by the caller is kept
+func (m *MethodTimeouts) Interceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	timeout, ok := m.byMethod[path.Base(info.FullMethod)]
+	if !ok {
+		timeout = m.all
+	}
+	if timeout == 0 {
+		return handler(ctx, req)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	resp, err := handler(ctx, req)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		// instead of the errInternal reported for the interrupted database access
+		return nil, errTimeout
+	}
+	return resp, err
+}
@@ -0,0 +1,102 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+func TestMethodTimeouts(t *testing.T) {
+	t.Setenv("RPC_TIMEOUT", "1h")
+	t.Setenv("RPC_METHOD_TIMEOUTS", "Verify=20ms, ListUsers=2h")
+	var timeouts MethodTimeouts
+	timeouts.Read(testLogger())
+
+	failure := errors.New("failure")
+	cases := []struct {
+		name   string
+		method string
+		// caller deadline, zero for none
+		callerTimeout time.Duration
+		// the handler waits for its deadline when set
+		blocks      bool
+		wantTimeout time.Duration
+		wantErr     error
+	}{
+		{"method timeout", "/puzzleloginservice.Login/Verify", 0, false, 20 * time.Millisecond, nil},
+		{"global timeout", "/puzzleloginservice.Login/Register", 0, false, time.Hour, nil},
+		{"longer method timeout", "/puzzleloginservice.Login/ListUsers", 0, false, 2 * time.Hour, nil},
+		{"shorter caller deadline", "/puzzleloginservice.Login/Register", time.Minute, false, time.Minute, nil},
+		{"expired", "/puzzleloginservice.Login/Verify", 0, true, 20 * time.Millisecond, errTimeout},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			if c.callerTimeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, c.callerTimeout)
+				defer cancel()
+			}
+
+			start := time.Now()
+			var remaining time.Duration
+			_, err := timeouts.Interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: c.method}, func(ctx context.Context, req any) (any, error) {
+				deadline, ok := ctx.Deadline()
+				if !ok {
+					t.Fatalf("no deadline set")
+				}
+				remaining = deadline.Sub(start)
+				if c.blocks {
+					<-ctx.Done()
+					// like a database access interrupted by the deadline
+					return nil, failure
+				}
+				return nil, nil
+			})
+			if err != c.wantErr {
+				t.Errorf("Interceptor() = %v, want %v", err, c.wantErr)
+			}
+			if slack := remaining - c.wantTimeout; slack > 5*time.Millisecond || slack < -5*time.Millisecond {
+				t.Errorf("deadline in %v, want %v", remaining, c.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestMethodTimeoutsDisabled(t *testing.T) {
+	t.Setenv("RPC_TIMEOUT", "")
+	t.Setenv("RPC_METHOD_TIMEOUTS", "")
+	var timeouts MethodTimeouts
+	timeouts.Read(testLogger())
+
+	_, err := timeouts.Interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/puzzleloginservice.Login/Verify"}, func(ctx context.Context, req any) (any, error) {
+		if _, ok := ctx.Deadline(); ok {
+			t.Errorf("a deadline is set without configuration")
+		}
+		return nil, nil
+	})
+	if err != nil {
+		t.Errorf("Interceptor() = %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/dvaumoron/puzzleloginserver/internal/envconfig"
+	"github.com/dvaumoron/puzzleloginserver/model"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"gorm.io/gorm"
+)
+
+var (
+	userBatchQueries  = expvar.NewInt("userBatchQueries")
+	userBatchRequests = expvar.NewInt("userBatchRequests")
+)
+
+type userBatch struct {
+	ids   map[uint64]struct{}
+	done  chan struct{}
+	users map[uint64]model.User
+	err   error
+}
+
+// userBatcher coalesces the GetUsers received during a short window in one query,
+// sparing duplicate reads when many pages show the same users. A nil userBatcher queries directly.
+type userBatcher struct {
+	mutex   sync.Mutex
+	db      *gorm.DB
+	window  time.Duration
+	maxIds  int
+	pending *userBatch
+}
+
+func newUserBatcher(db *gorm.DB, logger *otelzap.Logger) *userBatcher {
+	window := envconfig.ReadDuration(logger, "GET_USERS_BATCH_WINDOW", 0)
+	if window == 0 {
+		return nil
+	}
+
+	maxIds := int(envconfig.ReadUint(logger, "GET_USERS_BATCH_SIZE", 1000, 32))
+	return &userBatcher{db: db, window: window, maxIds: maxIds}
+}
+
+func (b *userBatcher) load(ctx context.Context, db *gorm.DB, ids []uint64) ([]model.User, error) {
+	if b == nil {
+		var users []model.User
+		err := db.Find(&users, "id IN ?", ids).Error
+		return users, err
+	}
+
+	userBatchRequests.Add(1)
+	b.mutex.Lock()
+	batch := b.pending
+	if batch == nil {
+		batch = &userBatch{ids: map[uint64]struct{}{}, done: make(chan struct{})}
+		b.pending = batch
+		time.AfterFunc(b.window, func() {
+			b.run(batch)
+		})
+	}
+	for _, id := range ids {
+		batch.ids[id] = struct{}{}
+	}
+	// a full batch still waits for its window, the next requests go in a new one
+	if len(batch.ids) >= b.maxIds {
+		b.pending = nil
+	}
+	b.mutex.Unlock()
+
+	select {
+	case <-batch.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if batch.err != nil {
+		return nil, batch.err
+	}
+
+	// each user once, like the direct query
+	users := make([]model.User, 0, len(ids))
+	seen := make(map[uint64]struct{}, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+
+		if user, ok := batch.users[id]; ok {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+// the query is shared, so it is not bound to the context of one of the requests
+func (b *userBatcher) run(batch *userBatch) {
+	b.mutex.Lock()
+	if b.pending == batch {
+		b.pending = nil
+	}
+	b.mutex.Unlock()
+
+	ids := make([]uint64, 0, len(batch.ids))
+	for id := range batch.ids {
+		ids = append(ids, id)
+	}
+
+	userBatchQueries.Add(1)
+	var users []model.User
+	batch.err = b.db.Find(&users, "id IN ?", ids).Error
+	batch.users = make(map[uint64]model.User, len(users))
+	for _, user := range users {
+		batch.users[user.ID] = user
+	}
+	close(batch.done)
+}
@@ -0,0 +1,113 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dvaumoron/puzzleloginserver/model"
+)
+
+func newTestBatcher(t *testing.T, maxIds int) *userBatcher {
+	db := testDB(t, &model.User{})
+	for _, login := range []string{"a", "b", "c", "d"} {
+		if err := db.Create(&model.User{Login: login}).Error; err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+	return &userBatcher{db: db, window: 20 * time.Millisecond, maxIds: maxIds}
+}
+
+func userLogins(users []model.User) string {
+	logins := ""
+	for _, user := range users {
+		logins += user.Login
+	}
+	return logins
+}
+
+func TestUserBatcher(t *testing.T) {
+	cases := []struct {
+		name        string
+		maxIds      int
+		requests    [][]uint64
+		wantLogins  []string
+		wantQueries int64
+	}{
+		{"single", 10, [][]uint64{{2, 1}}, []string{"ba"}, 1},
+		{"coalesced", 10, [][]uint64{{1, 2}, {2, 3}, {4}}, []string{"ab", "bc", "d"}, 1},
+		{"unknown ids", 10, [][]uint64{{1, 9}, {8}}, []string{"a", ""}, 1},
+		{"repeated ids", 10, [][]uint64{{1, 2, 1}, {3, 3}}, []string{"ab", "c"}, 1},
+		{"split when full", 2, [][]uint64{{1, 2}, {3, 4}}, []string{"ab", "cd"}, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			batcher := newTestBatcher(t, c.maxIds)
+			queries := userBatchQueries.Value()
+			results := make([][]model.User, len(c.requests))
+			errs := make([]error, len(c.requests))
+			var group sync.WaitGroup
+			// every request joins its batch well before the window ends
+			for i, ids := range c.requests {
+				group.Add(1)
+				go func(i int, ids []uint64) {
+					defer group.Done()
+					results[i], errs[i] = batcher.load(context.Background(), batcher.db, ids)
+				}(i, ids)
+			}
+			group.Wait()
+
+			for i, want := range c.wantLogins {
+				if errs[i] != nil {
+					t.Fatalf("load() failed: %v", errs[i])
+				}
+				if got := userLogins(results[i]); got != want {
+					t.Errorf("load(%v) = %q, want %q", c.requests[i], got, want)
+				}
+			}
+			if got := userBatchQueries.Value() - queries; got != c.wantQueries {
+				t.Errorf("got %d queries, want %d", got, c.wantQueries)
+			}
+		})
+	}
+}
+
+func TestUserBatcherCanceled(t *testing.T) {
+	batcher := newTestBatcher(t, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := batcher.load(ctx, batcher.db, []uint64{1}); err != context.Canceled {
+		t.Errorf("load() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestUserBatcherDisabled(t *testing.T) {
+	var batcher *userBatcher
+	db := newTestBatcher(t, 10).db
+	users, err := batcher.load(context.Background(), db.Order("login desc"), []uint64{1, 2})
+	if err != nil {
+		t.Fatalf("load() failed: %v", err)
+	}
+	if got := userLogins(users); got != "ba" {
+		t.Errorf("load() = %q, want %q", got, "ba")
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package loginserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+)
+
+const webhookTimeout = 5 * time.Second
+
+// webhook posts json payloads to url, failures of post are logged and counted under operation
+// (callers needing retries use send)
+type webhook struct {
+	url       string
+	operation string
+	client    *http.Client
+	logger    *otelzap.Logger
+}
+
+func newWebhook(url string, operation string, logger *otelzap.Logger) webhook {
+	return webhook{url: url, operation: operation, client: &http.Client{Timeout: webhookTimeout}, logger: logger}
+}
+
+func (w webhook) post(payload any) {
+	if err := w.send(payload); err != nil {
+		w.logger.Warn("Failed to call webhook", zap.String("operation", w.operation), zap.Error(err))
+		degraded(w.operation)
+	}
+}
+
+// a status of 400 or more is an error too
+func (w webhook) send(payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	response, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= http.StatusBadRequest {
+		return errors.New("payload refused with status " + strconv.Itoa(response.StatusCode))
+	}
+	return nil
+}
@@ -28,3 +28,25 @@ type User struct {
 	Login     string
 	Password  string
 }
+
+// Throttle counts the consecutive failed verifications for a subject (login or caller).
+type Throttle struct {
+	Subject      string `gorm:"primaryKey"`
+	UpdatedAt    time.Time
+	Failures     uint32
+	BlockedUntil time.Time
+}
+
+// PasswordHistory keeps previous password hashes of a user to prevent their reuse.
+type PasswordHistory struct {
+	ID        uint64
+	CreatedAt time.Time
+	UserID    uint64 `gorm:"index"`
+	Password  string
+}
+
+// Metadata stores values describing the data itself, like the version of its format.
+type Metadata struct {
+	Name  string `gorm:"primaryKey"`
+	Value string
+}
@@ -0,0 +1,96 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/dvaumoron/puzzleloginserver/model"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	pruneAction  = "prune"
+	mergeAction  = "merge"
+	manualAction = "manual"
+)
+
+type repairStep struct {
+	Kind    string   `json:"kind"`
+	Ids     []uint64 `json:"ids"`
+	Action  string   `json:"action"`
+	Detail  string   `json:"detail,omitempty"`
+	Applied bool     `json:"applied"`
+}
+
+// one json line per finding of check-integrity, only orphan pruning is applied (with -apply),
+// the other findings involve user accounts and are left to the operators
+func repairIntegrity(db *gorm.DB, logger *otelzap.Logger, args []string) {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	apply := flags.Bool("apply", false, "execute the repairs (dry run otherwise)")
+	kind := flags.String("kind", "", "only handle the findings of this kind")
+	flags.Parse(args)
+
+	report, err := checkIntegrity(db)
+	if err != nil {
+		logger.Fatal("Failed to check integrity", zap.Error(err))
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, issue := range report.Issues {
+		if *kind != "" && issue.Kind != *kind {
+			continue
+		}
+
+		step := planRepair(issue)
+		if *apply && step.Action == pruneAction {
+			if err = db.Delete(&model.PasswordHistory{}, step.Ids).Error; err != nil {
+				logger.Fatal("Failed to apply repair", zap.String("kind", step.Kind), zap.Error(err))
+			}
+			step.Applied = true
+			// audit trail of the changes made outside the service
+			logger.Info("Repair applied", zap.String("kind", step.Kind), zap.String("action", step.Action), zap.Uint64s("ids", step.Ids))
+		}
+		if err = encoder.Encode(step); err != nil {
+			logger.Fatal("Failed to write repair step", zap.Error(err))
+		}
+	}
+}
+
+func planRepair(issue integrityIssue) repairStep {
+	step := repairStep{Kind: issue.Kind, Ids: issue.Ids, Action: manualAction}
+	switch issue.Kind {
+	case orphanHistoryIssue:
+		step.Action = pruneAction
+		step.Detail = "delete the history entries"
+	case duplicateLoginIssue:
+		// ids are in creation order, the first account is the one most likely in use
+		step.Action = mergeAction
+		step.Detail = "keep the first user, rename or delete the others"
+	case emptyLoginIssue:
+		step.Detail = "contact the user or delete the account"
+	case unknownHashIssue:
+		step.Detail = "the password can not be verified, a reset is needed"
+	}
+	return step
+}
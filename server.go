@@ -19,19 +19,85 @@
 package main
 
 import (
+	"context"
 	_ "embed"
+	"expvar"
+	"os"
+	"time"
 
-	dbclient "github.com/dvaumoron/puzzledbclient"
 	grpcserver "github.com/dvaumoron/puzzlegrpcserver"
+	"github.com/dvaumoron/puzzleloginserver/hasher"
 	"github.com/dvaumoron/puzzleloginserver/loginserver"
 	pb "github.com/dvaumoron/puzzleloginservice"
+	"github.com/dvaumoron/puzzletelemetry"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"gorm.io/gorm"
 )
 
 //go:embed version.txt
 var version string
 
 func main() {
-	s := grpcserver.Make(loginserver.LoginKey, version)
-	pb.RegisterLoginServer(s, loginserver.New(dbclient.Create(s.Logger), s.Logger))
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
+	var timeouts loginserver.MethodTimeouts
+	s := grpcserver.Make(loginserver.LoginKey, version, grpc.ChainUnaryInterceptor(loginserver.RequestIdInterceptor, timeouts.Interceptor))
+	timeouts.Read(s.Logger)
+	startDebugServer(s.Logger)
+	db := createDB(s.Logger)
+	configurePool(db, s.Logger)
+	pb.RegisterLoginServer(s, loginserver.New(db, hasher.Create(s.Logger), loginserver.CreateNotifier(s.Logger), loginserver.SystemClock, s.Logger))
 	s.Start()
 }
+
+// offline maintenance commands, they share the server configuration but do not listen
+func runCommand(name string, args []string) {
+	logger, tp := puzzletelemetry.Init(loginserver.LoginKey, version)
+	defer tp.Shutdown(context.Background())
+
+	switch name {
+	case "check-integrity":
+		checkIntegrityCommand(createDB(logger), logger)
+	case "explain":
+		explainKeyQueries(createDB(logger), logger, args)
+	case "export-anonymized":
+		exportAnonymized(createDB(logger), logger)
+	case "hash-stats":
+		hashStats(createDB(logger), logger, args)
+	case "repair":
+		repairIntegrity(createDB(logger), logger, args)
+	case "tune-hash":
+		tuneHash(logger, args)
+	default:
+		logger.Fatal("Unknown command", zap.String("name", name))
+	}
+}
+
+// recycling connections lets the pool reach the new primary after a failover
+// (with a multi-host DB_SERVER_ADDR) instead of keeping sessions on a demoted node,
+// the pool statistics are published to make connection exhaustion visible
+func configurePool(db *gorm.DB, logger *otelzap.Logger) {
+	sqlDB, err := db.DB()
+	if err != nil {
+		logger.Fatal("Failed to access connection pool", zap.Error(err))
+	}
+	expvar.Publish("dbPool", expvar.Func(func() any {
+		return sqlDB.Stats()
+	}))
+
+	lifetimeStr := os.Getenv("DB_CONN_MAX_LIFETIME")
+	if lifetimeStr == "" {
+		return
+	}
+
+	lifetime, err := time.ParseDuration(lifetimeStr)
+	if err != nil {
+		logger.Fatal("Failed to parse DB_CONN_MAX_LIFETIME", zap.Error(err))
+	}
+	sqlDB.SetConnMaxLifetime(lifetime)
+}
@@ -0,0 +1,138 @@
+/*
+ *
+ * Copyright 2023 puzzleloginserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dvaumoron/puzzleloginserver/hasher"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.uber.org/zap"
+)
+
+const (
+	tuneStartMemory = 16 * 1024 // KiB
+	tuneMaxThreads  = 4
+	tuneRuns        = 3
+	tuneMaxTime     = 32
+)
+
+// increase memory first (what makes argon2id costly to attack), then iterations, while under the target
+func tuneHash(logger *otelzap.Logger, args []string) {
+	flags := flag.NewFlagSet("tune-hash", flag.ExitOnError)
+	target := flags.Duration("target", 250*time.Millisecond, "targeted duration for one verification")
+	maxMemory := flags.Uint("max-memory", 1024*1024, "maximum memory in KiB")
+	configPath := flags.String("write", "", "env file to update with the chosen parameters (printed otherwise)")
+	flags.Parse(args)
+	if *maxMemory > hasher.Argon2MaxMemory {
+		*maxMemory = hasher.Argon2MaxMemory
+	}
+
+	threads := runtime.NumCPU()
+	if threads > tuneMaxThreads {
+		threads = tuneMaxThreads
+	}
+
+	best := hasher.Argon2{Memory: tuneStartMemory, Time: 1, Threads: uint8(threads)}
+	if duration := measureHash(best); duration > *target {
+		logger.Warn("Minimal parameters are already slower than the target", zap.Duration("duration", duration))
+	} else {
+		for next := best; next.Memory*2 <= uint32(*maxMemory); {
+			next.Memory *= 2
+			if measureHash(next) > *target {
+				break
+			}
+			best = next
+		}
+		for next := best; next.Time < tuneMaxTime; {
+			next.Time++
+			if measureHash(next) > *target {
+				break
+			}
+			best = next
+		}
+	}
+
+	values := [][2]string{
+		{"PASSWORD_HASH", hasher.Argon2Scheme},
+		{"ARGON2_MEMORY", strconv.FormatUint(uint64(best.Memory), 10)},
+		{"ARGON2_TIME", strconv.FormatUint(uint64(best.Time), 10)},
+		{"ARGON2_THREADS", strconv.Itoa(int(best.Threads))},
+	}
+	fmt.Println("# measured", measureHash(best), "for a target of", *target)
+	if *configPath == "" {
+		for _, value := range values {
+			fmt.Println(value[0] + "=" + value[1])
+		}
+		return
+	}
+
+	if err := updateEnvFile(*configPath, values); err != nil {
+		logger.Fatal("Failed to update env file", zap.String("path", *configPath), zap.Error(err))
+	}
+	fmt.Println("Updated", *configPath)
+}
+
+// median of some runs
+func measureHash(params hasher.Argon2) time.Duration {
+	durations := make([]time.Duration, 0, tuneRuns)
+	for i := 0; i < tuneRuns; i++ {
+		start := time.Now()
+		params.Hash("tune-hash benchmark")
+		durations = append(durations, time.Since(start))
+	}
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i] < durations[j]
+	})
+	return durations[tuneRuns/2]
+}
+
+// replace the existing assignments and append the missing ones
+func updateEnvFile(path string, values [][2]string) error {
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(content) == 0 {
+		lines = nil
+	}
+	for _, value := range values {
+		assignment := value[0] + "=" + value[1]
+		replaced := false
+		for index, line := range lines {
+			if strings.HasPrefix(line, value[0]+"=") {
+				lines[index] = assignment
+				replaced = true
+			}
+		}
+		if !replaced {
+			lines = append(lines, assignment)
+		}
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}